@@ -0,0 +1,46 @@
+package main
+
+import (
+	"CSI-test/mounter"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+}
+
+var (
+	socket         = flag.String("socket", "/csi/mounter.sock", "unix socket the mount requests of the driver are received on")
+	credentialsDir = flag.String("credentialsdir", "/run/csi-s3", "tmpfs directory the driver writes the credential files of the fuse mounts to")
+	kubeletDir     = flag.String("kubeletdir", "/var/lib/kubelet", "directory of kubelet holding every path that is mounted")
+	cacheDirs      = flag.String("cachedirs", "/var/cache/csi-s3", "comma separated directories the fuse processes may keep their caches in")
+)
+
+func main() {
+	flag.Parse()
+
+	mounter.SetCredentialsDir(*credentialsDir)
+	var dirs []string
+	for _, dir := range strings.Split(*cacheDirs, ",") {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	mounter.RestrictMountHelper(*kubeletDir, dirs)
+
+	if err := os.Remove(*socket); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	listener, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chmod(*socket, 0600); err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(mounter.ServeMountHelper(listener))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"CSI-test/mounter"
 	"CSI-test/pkg/driver"
 	"flag"
 	"log"
@@ -12,14 +13,22 @@ func init() {
 }
 
 var (
-	endpoint = flag.String("endpoint", "http://127.0.0.1:9000", "CSI endpoint")
-	nodeID   = flag.String("nodeid", "", "node_id")
+	endpoint       = flag.String("endpoint", "http://127.0.0.1:9000", "CSI endpoint")
+	nodeID         = flag.String("nodeid", "", "node_id")
+	mountHelper    = flag.String("mounthelper", "", "unix socket of the mount helper running the fuse processes, they are run by the driver when empty")
+	credentialsDir = flag.String("credentialsdir", "/run/csi-s3", "tmpfs directory the credential files of the fuse mounts are written to")
+	stateDir       = flag.String("statedir", "/csi/volumes", "directory on the host where the mounted volumes are recorded")
 )
 
 func main() {
 	flag.Parse()
 
-	driver, err := driver.New(*nodeID, *endpoint)
+	mounter.SetCredentialsDir(*credentialsDir)
+	if *mountHelper != "" {
+		mounter.UseMountHelper(*mountHelper)
+	}
+
+	driver, err := driver.New(*nodeID, *endpoint, *stateDir)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -9,6 +9,7 @@ require (
 	github.com/minio/minio-go/v7 v7.0.57
 	github.com/mitchellh/go-ps v1.0.0
 	google.golang.org/grpc v1.55.0
+	google.golang.org/protobuf v1.30.0
 	k8s.io/mount-utils v0.27.3
 	k8s.io/utils v0.0.0-20230209194617-a36077c30491
 )
@@ -35,7 +36,6 @@ require (
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 	google.golang.org/genproto v0.0.0-20230306155012-7f2fa6fef1f4 // indirect
-	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	k8s.io/klog/v2 v2.90.1 // indirect
 )
@@ -0,0 +1,67 @@
+package mounter
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// tmpfsMagic is the filesystem type statfs reports for tmpfs.
+const tmpfsMagic = 0x01021994
+
+// credentialsDir holds a private directory per staged mount with the
+// credential files of its fuse process. It must be on tmpfs so the secrets
+// never reach a disk, and visible to the mount helper when one is used.
+var credentialsDir = "/run/csi-s3"
+
+// SetCredentialsDir changes the directory the credential files are written to.
+func SetCredentialsDir(dir string) {
+	credentialsDir = dir
+}
+
+// writeCredentials writes the credential file name of the fuse mount at
+// stagePath, replacing any previous content, and returns its path.
+func writeCredentials(stagePath string, name string, content string) (string, error) {
+	if err := os.MkdirAll(credentialsDir, 0700); err != nil {
+		return "", err
+	}
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(credentialsDir, &statfs); err != nil {
+		return "", fmt.Errorf("Error checking credentials directory: %v", err)
+	}
+	if statfs.Type != tmpfsMagic {
+		return "", fmt.Errorf("credentials directory %s is not on tmpfs", credentialsDir)
+	}
+
+	dir := mountCredentialsDir(stagePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, name)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return p, nil
+}
+
+// RemoveCredentials removes the credential files of the fuse mount at stagePath.
+// It is a no-op for mounts without credential files.
+func RemoveCredentials(stagePath string) error {
+	return os.RemoveAll(mountCredentialsDir(stagePath))
+}
+
+func mountCredentialsDir(stagePath string) string {
+	return filepath.Join(credentialsDir, mountID(stagePath))
+}
+
+// mountID names the files belonging to the fuse mount at stagePath.
+func mountID(stagePath string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(stagePath)))
+}
@@ -0,0 +1,181 @@
+package mounter
+
+import (
+	"CSI-test/pkg/s3"
+	"errors"
+	"fmt"
+	osexec "os/exec"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+// DefaultFsType is the filesystem of block device images without an explicit
+// type, which includes every volume created before the type was configurable.
+const DefaultFsType = "xfs"
+
+// filesystem holds the settings of a filesystem type for block device images.
+type filesystem struct {
+	mkfsArgs []string
+	// mountOptions are added to the options of every mount
+	mountOptions []string
+	// allowedFlags are the mount options that may be set through mountOptions
+	allowedFlags []string
+	// growArgs returns the command growing the filesystem mounted from device at target
+	growArgs func(device string, target string) []string
+}
+
+// commonAllowedFlags are the mount options every filesystem type accepts
+var commonAllowedFlags = []string{
+	"ro", "noatime", "nodiratime", "relatime", "nosuid", "nodev", "noexec", "discard", "nodiscard",
+}
+
+var filesystems = map[string]filesystem{
+	"xfs": {
+		// the images of cloned volumes share the uuid of their source
+		mountOptions: []string{"nouuid"},
+		allowedFlags: append([]string{"inode64", "largeio", "allocsize", "logbufs", "logbsize"}, commonAllowedFlags...),
+		growArgs: func(device string, target string) []string {
+			return []string{"xfs_growfs", target}
+		},
+	},
+	"ext4": {
+		// the image is a regular file, and reserved blocks only waste space on a volume
+		mkfsArgs:     []string{"-F", "-m", "0"},
+		allowedFlags: append([]string{"data", "commit", "barrier", "nobarrier", "errors", "nodelalloc", "dioread_nolock"}, commonAllowedFlags...),
+		growArgs: func(device string, target string) []string {
+			return []string{"resize2fs", device}
+		},
+	},
+	"btrfs": {
+		mountOptions: []string{"compress=zstd"},
+		allowedFlags: append([]string{"compress", "compress-force", "autodefrag", "noautodefrag", "commit", "ssd", "nossd", "datasum", "nodatasum"}, commonAllowedFlags...),
+		growArgs: func(device string, target string) []string {
+			return []string{"btrfs", "filesystem", "resize", "max", target}
+		},
+	},
+}
+
+// FsType returns the filesystem type of the block device image of a volume.
+func FsType(meta *s3.FSMeta) string {
+	if meta.FsType == "" {
+		return DefaultFsType
+	}
+	return meta.FsType
+}
+
+// ValidateFsType ensures fsType is supported for block device images.
+func ValidateFsType(fsType string) error {
+	if _, ok := filesystems[fsType]; !ok {
+		var supported []string
+		for t := range filesystems {
+			supported = append(supported, t)
+		}
+		sort.Strings(supported)
+		return fmt.Errorf("filesystem type %q is not supported, use one of %s", fsType, strings.Join(supported, ", "))
+	}
+	return nil
+}
+
+// prepareFs formats device when it holds no filesystem yet. An existing
+// filesystem is checked when check is set, which is reading all its metadata
+// from S3 and only worth it after an unclean unmount. A device of an
+// initialized volume without a filesystem is reported as an error rather
+// than formatted, as the filesystem was most likely not read correctly.
+func prepareFs(fsType string, device string, initialized bool, check bool) error {
+	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
+	format, err := diskMounter.GetDiskFormat(device)
+	if err != nil {
+		return fmt.Errorf("Error detecting filesystem on %s: %v", device, err)
+	}
+	if format == "" {
+		if initialized {
+			return fmt.Errorf("no filesystem found on %s although the volume was initialized", device)
+		}
+		return formatFs(fsType, device)
+	}
+	if format != fsType {
+		return fmt.Errorf("%s holds a %s filesystem instead of %s", device, format, fsType)
+	}
+	glog.Infof("Disk %s is already formatted with format %s", device, format)
+	if !check {
+		return nil
+	}
+	glog.Infof("Volume was not unstaged cleanly, checking the filesystem on %s", device)
+	return checkFs(fsType, device)
+}
+
+func formatFs(fsType string, device string) error {
+	glog.Infof("Formatting fs with type %s", fsType)
+	args := append(append([]string{}, filesystems[fsType].mkfsArgs...), device)
+	cmd := osexec.Command("mkfs."+fsType, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error formatting disk: %s", out)
+	}
+	return nil
+}
+
+// checkFs repairs the filesystem on device when it was left inconsistent.
+func checkFs(fsType string, device string) error {
+	switch fsType {
+	case "xfs":
+		// xfs has no fsck, check without modifying first
+		out, err := osexec.Command("xfs_repair", "-n", device).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		glog.Warningf("Filesystem on %s needs repair: %s", device, out)
+		if out, err := osexec.Command("xfs_repair", device).CombinedOutput(); err != nil {
+			// a dirty log is replayed by mounting, which is up to the mount to report
+			glog.Warningf("Error repairing filesystem on %s, mounting it anyway: %s", device, out)
+		}
+		return nil
+	case "btrfs":
+		// btrfs verifies its checksums while mounted, btrfs check is not safe to repair with
+		return nil
+	default:
+		out, err := osexec.Command("fsck", "-a", device).CombinedOutput()
+		var exitErr *osexec.ExitError
+		// exit code 1 means errors were corrected
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			glog.Infof("Filesystem errors on %s were corrected: %s", device, out)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error checking filesystem on %s: %s", device, out)
+		}
+		return nil
+	}
+}
+
+// growFs grows the filesystem mounted at target to the size of its device.
+func growFs(fsType string, target string) error {
+	device, err := mountedDevice(target)
+	if err != nil {
+		return err
+	}
+	args := filesystems[fsType].growArgs(device, target)
+	out, err := osexec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error growing filesystem: %s", out)
+	}
+	return nil
+}
+
+// mountedDevice returns the device mounted at path.
+func mountedDevice(path string) (string, error) {
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		return "", err
+	}
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		if mountPoints[i].Path == path {
+			return mountPoints[i].Device, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not mounted", path)
+}
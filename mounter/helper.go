@@ -0,0 +1,377 @@
+package mounter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+const (
+	helperMountOp   = "mount"
+	helperUnmountOp = "unmount"
+)
+
+// mountHelperSocket is the unix socket of the mount helper, fuse mounts are
+// made by the driver itself when it is empty.
+var mountHelperSocket string
+
+// execMutex is held while a command is started and its pid recorded, so the
+// orphan reaper of the mount helper never collects the exit status of a
+// command that is still to be waited for.
+var execMutex sync.Mutex
+
+// execPids are the pids of the commands started by runCommand and not waited for yet.
+var execPids = map[int]struct{}{}
+
+// helperKubeletDir holds every path the mount helper mounts or unmounts.
+var helperKubeletDir = "/var/lib/kubelet"
+
+// helperCacheDirs hold the caches the fuse processes of the mount helper may
+// keep on disk, the directories it creates and the files it removes.
+var helperCacheDirs = []string{"/var/cache/csi-s3"}
+
+// helperCommand is a fuse command the mount helper runs. The socket must not
+// become a way to run anything else as root, which a variable like
+// LD_PRELOAD, a subcommand other than mount or a flag pointing at host paths
+// would allow.
+type helperCommand struct {
+	// env are the environment variables the command may be given
+	env []string
+	// checkArgs ensures args only mount a bucket at path
+	checkArgs func(path string, args []string) error
+}
+
+var helperCommands = map[string]helperCommand{
+	s3fsCmd:     {checkArgs: checkS3fsArgs},
+	s3backerCmd: {checkArgs: checkS3backerArgs},
+	rcloneCmd:   {env: []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"}, checkArgs: checkRcloneArgs},
+}
+
+// helperFlags are the flags of a fuse command the mount helper passes on,
+// those set by the mounter and those allowed as mount flags. The value of a
+// path flag must be below one of the roots returned for it.
+type helperFlags struct {
+	allowed   []string
+	pathFlags map[string]func() []string
+}
+
+func credentialsRoots() []string {
+	return []string{credentialsDir}
+}
+
+func cacheRoots() []string {
+	return helperCacheDirs
+}
+
+var s3fsHelperFlags = helperFlags{
+	allowed:   append([]string{"use_path_request_style", "url", "endpoint", "allow_other"}, s3fsAllowedFlags...),
+	pathFlags: map[string]func() []string{"passwd_file": credentialsRoots},
+}
+
+var s3backerHelperFlags = helperFlags{
+	allowed: []string{
+		"blockSize", "size", "prefix", "listBlocks", "region", "baseURL", "ssl", "force",
+		"blockCacheSize", "blockCacheThreads", "md5CacheSize", "md5CacheTime", "compress", "encrypt",
+	},
+	pathFlags: map[string]func() []string{
+		"accessFile":     credentialsRoots,
+		"passwordFile":   credentialsRoots,
+		"blockCacheFile": cacheRoots,
+	},
+}
+
+var rcloneHelperFlags = helperFlags{
+	allowed: append([]string{
+		"daemon", "s3-provider", "s3-env-auth", "s3-region", "s3-endpoint", "allow-other",
+	}, rcloneAllowedFlags...),
+}
+
+// RestrictMountHelper sets the directories the mount helper limits the paths
+// of its requests to, see helperKubeletDir and helperCacheDirs.
+func RestrictMountHelper(kubeletDir string, cacheDirs []string) {
+	helperKubeletDir = kubeletDir
+	helperCacheDirs = cacheDirs
+}
+
+// helperRequest asks the mount helper to run a fuse mount command, or to
+// unmount a fuse mount, wait for its process to end and remove its Files.
+type helperRequest struct {
+	Op      string   `json:"Op"`
+	Path    string   `json:"Path"`
+	Command string   `json:"Command,omitempty"`
+	Args    []string `json:"Args,omitempty"`
+	Env     []string `json:"Env,omitempty"`
+	Dirs    []string `json:"Dirs,omitempty"`
+	Files   []string `json:"Files,omitempty"`
+}
+
+type helperResponse struct {
+	Error string `json:"Error,omitempty"`
+}
+
+// UseMountHelper makes the fuse processes run in the mount helper listening on
+// socket rather than as children of the driver, so they survive a restart or
+// an upgrade of the driver.
+func UseMountHelper(socket string) {
+	mountHelperSocket = socket
+}
+
+// ServeMountHelper runs the fuse mount and unmount requests received on
+// listener until it is closed. The fuse processes are owned by the calling
+// process, which should be long lived.
+func ServeMountHelper(listener net.Listener) error {
+	go reapOrphans()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveHelperConn(conn)
+	}
+}
+
+func serveHelperConn(conn net.Conn) {
+	defer conn.Close()
+	var req helperRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		glog.Errorf("Invalid mount helper request: %v", err)
+		return
+	}
+	var err error
+	switch req.Op {
+	case helperMountOp:
+		glog.Infof("Mounting %s for the driver", req.Path)
+		err = checkHelperRequest(&req)
+		if err == nil {
+			err = runFuseMount(req.Path, req.Command, req.Args, req.Env, req.Dirs)
+		}
+	case helperUnmountOp:
+		glog.Infof("Unmounting %s for the driver", req.Path)
+		err = checkHelperRequest(&req)
+		if err == nil {
+			err = runFuseUnmount(req.Path, req.Files)
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	resp := helperResponse{}
+	if err != nil {
+		glog.Errorf("Mount helper %s of %s failed: %v", req.Op, req.Path, err)
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		glog.Errorf("Failed to reply to mount helper request: %v", err)
+	}
+}
+
+// checkHelperRequest ensures the mount helper may serve req, which only
+// touches the paths of the volumes and their caches.
+func checkHelperRequest(req *helperRequest) error {
+	if !isBelow(req.Path, []string{helperKubeletDir}) {
+		return fmt.Errorf("path %q is outside of %s", req.Path, helperKubeletDir)
+	}
+	for _, p := range append(append([]string{}, req.Dirs...), req.Files...) {
+		if !isBelow(p, helperCacheDirs) {
+			return fmt.Errorf("path %q is outside of %s", p, strings.Join(helperCacheDirs, ", "))
+		}
+	}
+	if req.Op != helperMountOp {
+		return nil
+	}
+	command, ok := helperCommands[req.Command]
+	if !ok {
+		return fmt.Errorf("command %q is not a fuse mount command", req.Command)
+	}
+	for _, e := range req.Env {
+		name, _, _ := strings.Cut(e, "=")
+		allowed := false
+		for _, a := range command.env {
+			if name == a {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("environment variable %q is not allowed for %s", name, req.Command)
+		}
+	}
+	return command.checkArgs(req.Path, req.Args)
+}
+
+// checkS3fsArgs accepts the bucket, path and single options given with -o.
+func checkS3fsArgs(path string, args []string) error {
+	if len(args) < 2 || strings.HasPrefix(args[0], "-") || args[1] != path {
+		return fmt.Errorf("%s must be given the bucket and %s", s3fsCmd, path)
+	}
+	options := args[2:]
+	for i := 0; i < len(options); i += 2 {
+		// several comma separated options would hide all but the first
+		if options[i] != "-o" || i+1 == len(options) || strings.Contains(options[i+1], ",") {
+			return fmt.Errorf("%s options must be given one by one with -o", s3fsCmd)
+		}
+		if err := s3fsHelperFlags.check(s3fsCmd, options[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkS3backerArgs accepts the bucket and path followed by flags.
+func checkS3backerArgs(path string, args []string) error {
+	if len(args) < 2 || strings.HasPrefix(args[0], "-") || args[1] != path {
+		return fmt.Errorf("%s must be given the bucket and %s", s3backerCmd, path)
+	}
+	return s3backerHelperFlags.checkAll(s3backerCmd, args[2:])
+}
+
+// checkRcloneArgs accepts the mount subcommand of an s3 remote at path followed by flags.
+func checkRcloneArgs(path string, args []string) error {
+	if len(args) < 3 || args[0] != "mount" || !strings.HasPrefix(args[1], ":s3:") || args[2] != path {
+		return fmt.Errorf("%s must be given mount, an s3 remote and %s", rcloneCmd, path)
+	}
+	return rcloneHelperFlags.checkAll(rcloneCmd, args[3:])
+}
+
+// checkAll checks flags given as --name or --name=value.
+func (f helperFlags) checkAll(command string, flags []string) error {
+	for _, flag := range flags {
+		if !strings.HasPrefix(flag, "--") {
+			return fmt.Errorf("argument %q of %s is not a flag", flag, command)
+		}
+		if err := f.check(command, strings.TrimPrefix(flag, "--")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check checks a flag given as name or name=value.
+func (f helperFlags) check(command string, flag string) error {
+	name, value, _ := strings.Cut(flag, "=")
+	if roots, ok := f.pathFlags[name]; ok {
+		if !isBelow(value, roots()) {
+			return fmt.Errorf("%s of %s is outside of %s", name, command, strings.Join(roots(), ", "))
+		}
+		return nil
+	}
+	for _, a := range f.allowed {
+		if name == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("flag %q is not allowed for %s", name, command)
+}
+
+// isBelow reports whether the absolute path p is one of roots or below one.
+func isBelow(p string, roots []string) bool {
+	if !filepath.IsAbs(p) {
+		return false
+	}
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// callMountHelper sends req to the mount helper and waits for it to be done.
+func callMountHelper(req *helperRequest) error {
+	conn, err := net.Dial("unix", mountHelperSocket)
+	if err != nil {
+		return fmt.Errorf("Error connecting to mount helper: %v", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	var resp helperResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("Error reading mount helper response: %v", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// reapOrphans collects the fuse daemons that exit after having been detached
+// from their mount command. The mount helper usually runs as pid 1 of its
+// container and inherits them.
+func reapOrphans() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	for range sigs {
+		execMutex.Lock()
+		for _, pid := range zombieChildren() {
+			// runCommand waits for its commands itself
+			if _, ok := execPids[pid]; ok {
+				continue
+			}
+			var ws syscall.WaitStatus
+			if _, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); err == nil {
+				glog.V(4).Infof("Fuse process %d exited with status %d", pid, ws.ExitStatus())
+			}
+		}
+		execMutex.Unlock()
+	}
+}
+
+// zombieChildren returns the pids of the children of this process that exited.
+func zombieChildren() []int {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, stat := range stats {
+		b, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// the command name in parentheses may contain anything, the fields follow it
+		i := strings.LastIndexByte(string(b), ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(b[i+1:]))
+		if len(fields) < 2 || fields[0] != "Z" || fields[1] != strconv.Itoa(self) {
+			continue
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat))); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// runCommand runs cmd like cmd.Run, keeping its exit status from the orphan reaper.
+func runCommand(cmd *exec.Cmd) error {
+	execMutex.Lock()
+	err := cmd.Start()
+	if err == nil {
+		execPids[cmd.Process.Pid] = struct{}{}
+	}
+	execMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	execMutex.Lock()
+	delete(execPids, cmd.Process.Pid)
+	execMutex.Unlock()
+	return err
+}
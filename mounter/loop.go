@@ -0,0 +1,120 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+const (
+	loopControl = "/dev/loop-control"
+	// loopCtlGetFree is the LOOP_CTL_GET_FREE ioctl of loop-control, it
+	// returns the number of a free loop device, adding one when needed
+	loopCtlGetFree = 0x4C82
+	loopMajor      = 7
+	// loopAttachRetries bounds the retries when another process takes the
+	// free loop device between finding and attaching it
+	loopAttachRetries = 5
+)
+
+// attachLoopDevice attaches file to a free loop device and returns the
+// device. A device already backed by file with the same mode is reused.
+func attachLoopDevice(file string, readOnly bool) (string, error) {
+	device, err := loopDeviceOf(file, readOnly)
+	if err != nil {
+		return "", err
+	}
+	if device != "" {
+		return device, nil
+	}
+
+	for i := 0; i < loopAttachRetries; i++ {
+		device, err = freeLoopDevice()
+		if err != nil {
+			return "", err
+		}
+		args := []string{device, file}
+		if readOnly {
+			args = append([]string{"--read-only"}, args...)
+		}
+		out, err := exec.Command("losetup", args...).CombinedOutput()
+		if err == nil {
+			glog.Infof("Attached %s to loop device %s", file, device)
+			return device, nil
+		}
+		glog.Warningf("Error attaching %s to loop device %s: %s", file, device, out)
+	}
+	return "", fmt.Errorf("Error attaching %s to a loop device", file)
+}
+
+// detachLoopDevice detaches the loop devices backed by file, if any.
+func detachLoopDevice(file string) error {
+	for _, readOnly := range []bool{false, true} {
+		device, err := loopDeviceOf(file, readOnly)
+		if err != nil {
+			return err
+		}
+		if device == "" {
+			continue
+		}
+		out, err := exec.Command("losetup", "-d", device).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Error detaching loop device %s: %s", device, out)
+		}
+		glog.Infof("Detached loop device %s of %s", device, file)
+	}
+	return nil
+}
+
+// loopDeviceOf returns the read-only or writable loop device backed by file,
+// or an empty string when there is none. The kernel keeps track of the
+// backing files, which remains correct across restarts of the driver.
+func loopDeviceOf(file string, readOnly bool) (string, error) {
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return "", err
+	}
+	for _, backingFile := range backingFiles {
+		b, err := os.ReadFile(backingFile)
+		if err != nil {
+			// the device was detached meanwhile
+			continue
+		}
+		if strings.TrimSpace(string(b)) != file {
+			continue
+		}
+		sysDir := filepath.Dir(filepath.Dir(backingFile))
+		ro, err := os.ReadFile(filepath.Join(sysDir, "ro"))
+		if err != nil {
+			continue
+		}
+		if (strings.TrimSpace(string(ro)) == "1") == readOnly {
+			return filepath.Join("/dev", filepath.Base(sysDir)), nil
+		}
+	}
+	return "", nil
+}
+
+// freeLoopDevice returns a free loop device, creating its device node when
+// the /dev of the container does not have it yet.
+func freeLoopDevice() (string, error) {
+	control, err := os.OpenFile(loopControl, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("Error opening %s: %v", loopControl, err)
+	}
+	defer control.Close()
+	n, _, errno := syscall.Syscall(syscall.SYS_IOCTL, control.Fd(), loopCtlGetFree, 0)
+	if errno != 0 {
+		return "", fmt.Errorf("Error finding a free loop device: %v", errno)
+	}
+	device := fmt.Sprintf("/dev/loop%d", n)
+	if err := createLoopDevice(device, int(n)); err != nil {
+		return "", err
+	}
+	return device, nil
+}
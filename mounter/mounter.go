@@ -2,6 +2,7 @@ package mounter
 
 import (
 	"CSI-test/pkg/s3"
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/golang/glog"
@@ -10,6 +11,7 @@ import (
 	"k8s.io/utils/mount"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -19,11 +21,22 @@ import (
 Mounter interface which can be implemented by the different mounter types
 */
 type Mounter interface {
-	Stage(stagePath string) error
+	Stage(stagePath string, mountFlags []string) error
 	Unstage(stagePath string) error
-	Mount(source string, target string) error
+	Mount(source string, target string, opts PublishOptions) error
+	Expand(stagePath string, target string) error
 }
 
+// PublishOptions are the options a volume is published to a pod with.
+type PublishOptions struct {
+	ReadOnly bool
+	// MountFlags are passed through to the mounter after validation
+	MountFlags []string
+}
+
+// ErrInvalidMountFlag is returned by Mount for a mount flag the mounter does not allow.
+var ErrInvalidMountFlag = errors.New("invalid mount flag")
+
 const (
 	s3fsMounterType     = "s3fs"
 	goofysMounterType   = "goofys"
@@ -33,6 +46,18 @@ const (
 	BucketKey           = "bucket"
 	VolumePrefix        = "prefix"
 	UsePrefix           = "usePrefix"
+	PoolSizeKey         = "poolSize"
+	PoolKey             = "pool"
+	FsTypeKey           = "fsType"
+	// the tuning of s3backer volumes
+	BlockSizeKey         = "blockSize"
+	BlockCacheSizeKey    = "blockCacheSize"
+	BlockCacheThreadsKey = "blockCacheThreads"
+	BlockCacheDirKey     = "blockCacheDir"
+	CompressKey          = "compress"
+	EncryptKey           = "encrypt"
+	MD5CacheSizeKey      = "md5CacheSize"
+	MD5CacheTimeKey      = "md5CacheTime"
 )
 
 // New returns a new mounter depending on the mounterType parameter
@@ -56,22 +81,195 @@ func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	}
 }
 
-func fuseMount(path string, command string, args []string) error {
+// NeedsNodeExpansion reports whether growing the volume requires work on the
+// node, which is only the case for the s3backer block device.
+func NeedsNodeExpansion(meta *s3.FSMeta) bool {
+	return IsBlockMounter(meta.Mounter)
+}
+
+// SameDataLayout reports whether volumes of both mounter types store their
+// data the same way, so that one can be populated from the other.
+func SameDataLayout(mounterType string, otherType string) bool {
+	return IsBlockMounter(mounterType) == IsBlockMounter(otherType)
+}
+
+// SupportsMultiNode reports whether the volume may be published on several
+// nodes at once. The s3backer filesystem image can only be used by one node.
+func SupportsMultiNode(mounterType string) bool {
+	return !IsBlockMounter(mounterType)
+}
+
+// IsBlockMounter reports whether the mounter stores a block device image in
+// the bucket rather than one object per file. It mirrors the fallback of New.
+func IsBlockMounter(mounterType string) bool {
+	switch mounterType {
+	case s3fsMounterType, rcloneMounterType:
+		return false
+	default:
+		return true
+	}
+}
+
+// MountedType returns the mounter type of the fuse filesystem mounted at path,
+// or an empty string when no fuse filesystem of a known mounter is mounted there.
+func MountedType(path string) (string, error) {
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		return "", err
+	}
+	// the last entry is the topmost mount on path
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		if mountPoints[i].Path != path {
+			continue
+		}
+		switch mounterType := strings.TrimPrefix(mountPoints[i].Type, "fuse."); mounterType {
+		case s3fsMounterType, s3backerMounterType, rcloneMounterType:
+			return mounterType, nil
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// splitMountFlags splits comma separated mount flags into single flags.
+func splitMountFlags(flags []string) []string {
+	var split []string
+	for _, flag := range flags {
+		for _, f := range strings.Split(flag, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				split = append(split, f)
+			}
+		}
+	}
+	return split
+}
+
+// checkMountFlags ensures every flag, in the form name or name=value, is in allowed.
+// Flags that are not known to be harmless, such as those pointing the mounter at
+// host paths or other credentials, are rejected.
+func checkMountFlags(flags []string, allowed []string) error {
+	for _, flag := range flags {
+		name := strings.TrimLeft(strings.SplitN(flag, "=", 2)[0], "-")
+		ok := false
+		for _, a := range allowed {
+			if name == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrInvalidMountFlag, flag)
+		}
+	}
+	return nil
+}
+
+// sharedMount implements Mount and Expand for the mounters staging one fuse
+// mount per node, which every pod of the node then shares through a bind
+// mount. The mount flags were applied by Stage. The fuse mount has no size,
+// the new logical size of an expansion is only recorded in the metadata.
+type sharedMount struct{}
+
+func (sharedMount) Mount(source string, target string, opts PublishOptions) error {
+	return bindMount(source, target, opts.ReadOnly)
+}
+
+func (sharedMount) Expand(stagePath string, target string) error {
+	return nil
+}
+
+// bindMount shares the fuse mount staged at source with target.
+func bindMount(source string, target string, readOnly bool) error {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return mount.New("").Mount(source, target, "", options)
+}
+
+// mountOptions returns the options path is currently mounted with.
+func mountOptions(path string) ([]string, error) {
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		if mountPoints[i].Path == path {
+			return mountPoints[i].Opts, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not mounted", path)
+}
+
+// fuseMount runs the fuse mount command, in the mount helper when one is used.
+// env is added to the environment of the command only, it may hold secrets.
+// dirs are created before, on the side running the command.
+func fuseMount(path string, command string, args []string, env []string, dirs []string) error {
+	if mountHelperSocket != "" {
+		return callMountHelper(&helperRequest{Op: helperMountOp, Path: path, Command: command, Args: args, Env: env, Dirs: dirs})
+	}
+	return runFuseMount(path, command, args, env, dirs)
+}
+
+func runFuseMount(path string, command string, args []string, env []string, dirs []string) error {
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("directory %q of the fuse mount is not absolute", dir)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
 	cmd := exec.Command(command, args...)
 	glog.V(3).Infof("Mounting fuse with command: %s and args: %s", command, args)
+	cmd.Env = append(os.Environ(), env...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(cmd); err != nil {
 		return fmt.Errorf("Error fuseMount command: %s\nargs: %s\noutput", command, args)
 	}
 	return waitForMount(path, 10*time.Second)
 }
 
+// FuseUnmount unmounts the fuse mount at path and waits for its process to
+// end, in the mount helper when one is used.
 func FuseUnmount(path string) error {
-	if err := mount.New("").Unmount(path); err != nil {
+	return fuseUnmount(path, nil)
+}
+
+// fuseUnmount is FuseUnmount also removing the files the fuse process kept
+// on the side running it, once the process ended.
+func fuseUnmount(path string, files []string) error {
+	if mountHelperSocket != "" {
+		return callMountHelper(&helperRequest{Op: helperUnmountOp, Path: path, Files: files})
+	}
+	return runFuseUnmount(path, files)
+}
+
+func runFuseUnmount(path string, files []string) error {
+	if err := unmountFuseProcess(path); err != nil {
 		return err
 	}
+	for _, file := range files {
+		if !filepath.IsAbs(file) {
+			return fmt.Errorf("file %q of the fuse mount is not absolute", file)
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmountFuseProcess(path string) error {
+	// not through mount-utils, its umount command has to be kept from the orphan reaper
+	var out bytes.Buffer
+	cmd := exec.Command("umount", path)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("Error unmounting %s: %v, output: %s", path, err, out.String())
+	}
 	process, err := findFuseMountProcess(path)
 	if err != nil {
 		glog.Errorf("Error getting PID of fuse mount: %s", err)
@@ -158,13 +356,13 @@ func getCmdLine(pid int) (string, error) {
 	return string(cmdLine), nil
 }
 
-func createLoopDevice(device string) error {
+func createLoopDevice(device string, n int) error {
 	if _, err := os.Stat(device); !os.IsNotExist(err) {
 		return nil
 	}
 	args := []string{
 		device,
-		"b", "7", "0",
+		"b", fmt.Sprint(loopMajor), fmt.Sprint(n),
 	}
 	cmd := exec.Command("mknod", args...)
 	out, err := cmd.CombinedOutput()
@@ -2,14 +2,15 @@ package mounter
 
 import (
 	"fmt"
-	"os"
 	"path"
+	"strings"
 
 	"CSI-test/pkg/s3"
 )
 
 // Implements Mounter
 type rcloneMounter struct {
+	sharedMount
 	meta            *s3.FSMeta
 	url             string
 	region          string
@@ -21,6 +22,15 @@ const (
 	rcloneCmd = "rclone"
 )
 
+// rcloneAllowedFlags are the rclone mount flags that may be set through mountOptions
+var rcloneAllowedFlags = []string{
+	"read-only", "uid", "gid", "umask", "dir-perms", "file-perms", "no-modtime", "no-checksum",
+	"vfs-cache-mode", "vfs-cache-max-age", "vfs-cache-max-size", "vfs-cache-poll-interval",
+	"vfs-read-chunk-size", "vfs-read-chunk-size-limit", "vfs-write-back",
+	"dir-cache-time", "attr-timeout", "poll-interval", "buffer-size", "transfers",
+	"s3-chunk-size", "s3-upload-concurrency", "s3-upload-cutoff",
+}
+
 func newRcloneMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	return &rcloneMounter{
 		meta:            meta,
@@ -31,29 +41,36 @@ func newRcloneMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	}, nil
 }
 
-func (rclone *rcloneMounter) Stage(stageTarget string) error {
-	return nil
-}
-
-func (rclone *rcloneMounter) Unstage(stageTarget string) error {
-	return nil
-}
-
-func (rclone *rcloneMounter) Mount(source string, target string) error {
+// Stage mounts the volume at stageTarget, passing the credentials in the environment.
+func (rclone *rcloneMounter) Stage(stageTarget string, mountFlags []string) error {
+	flags := splitMountFlags(mountFlags)
+	if err := checkMountFlags(flags, rcloneAllowedFlags); err != nil {
+		return err
+	}
 	args := []string{
 		"mount",
 		fmt.Sprintf(":s3:%s", path.Join(rclone.meta.BucketName, rclone.meta.Prefix, rclone.meta.FSPath)),
-		fmt.Sprintf("%s", target),
+		fmt.Sprintf("%s", stageTarget),
 		"--daemon",
 		"--s3-provider=AWS",
 		"--s3-env-auth=true",
 		fmt.Sprintf("--s3-region=%s", rclone.region),
 		fmt.Sprintf("--s3-endpoint=%s", rclone.url),
 		"--allow-other",
-		// TODO: make this configurable
 		"--vfs-cache-mode=writes",
 	}
-	os.Setenv("AWS_ACCESS_KEY_ID", rclone.accessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", rclone.secretAccessKey)
-	return fuseMount(target, rcloneCmd, args)
+	// later flags override the defaults above
+	for _, flag := range flags {
+		args = append(args, "--"+strings.TrimLeft(flag, "-"))
+	}
+	// --s3-env-auth reads the keys from the environment of the rclone process
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + rclone.accessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + rclone.secretAccessKey,
+	}
+	return fuseMount(stageTarget, rcloneCmd, args, env, nil)
+}
+
+func (rclone *rcloneMounter) Unstage(stageTarget string) error {
+	return FuseUnmount(stageTarget)
 }
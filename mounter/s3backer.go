@@ -2,14 +2,14 @@ package mounter
 
 import (
 	"CSI-test/pkg/s3"
+	"errors"
 	"fmt"
 	"github.com/golang/glog"
 	"k8s.io/mount-utils"
-	"k8s.io/utils/exec"
 	"net/url"
 	"os"
-	osexec "os/exec"
 	"path"
+	"path/filepath"
 )
 
 // Implements Mounter
@@ -19,17 +19,24 @@ type s3backerMounter struct {
 	region          string
 	accessKeyID     string
 	secretAccessKey string
+	encryptionKey   string
 	ssl             bool
 }
 
 const (
 	s3backerCmd    = "s3backer"
-	s3backerFsType = "xfs"
 	s3backerDevice = "file"
-	// blockSize to use in k
-	s3backerBlockSize = 1024 * 1024 * 1024 // 1GiB
-	// S3backerLoopDevice the loop device required by s3backer
-	S3backerLoopDevice = "/dev/loop0"
+	// s3backerPasswdFile is the name of the credential file of a mount
+	s3backerPasswdFile = "s3backer_passwd"
+	// s3backerEncryptionFile is the name of the file holding the encryption key of a mount
+	s3backerEncryptionFile = "s3backer_encryption"
+	// S3backerDefaultBlockSize is the block size in bytes of new volumes
+	// created without one. Every write of a partial block reads and writes
+	// back the whole block, so it is kept small.
+	S3backerDefaultBlockSize = 1024 * 1024 // 1MiB
+	// s3backerLegacyBlockSize is the block size of volumes created before the
+	// block size was recorded in their metadata
+	s3backerLegacyBlockSize = 1024 * 1024 * 1024 // 1GiB
 )
 
 func newS3backerMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
@@ -40,7 +47,7 @@ func newS3backerMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	url.Path = path.Join(url.Path, meta.BucketName, meta.Prefix, meta.FSPath)
 	//s3backer cannot work with 0 size volumes
 	if meta.CapacityBytes == 0 {
-		meta.CapacityBytes = s3backerBlockSize
+		meta.CapacityBytes = S3backerBlockSize(meta)
 	}
 	s3backer := &s3backerMounter{
 		meta:            meta,
@@ -48,104 +55,249 @@ func newS3backerMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 		region:          cfg.Region,
 		accessKeyID:     cfg.AccessKeyID,
 		secretAccessKey: cfg.SecretAccessKey,
+		encryptionKey:   cfg.EncryptionKey,
 		ssl:             url.Scheme == "https",
 	}
-	return s3backer, s3backer.writePasswd()
+	return s3backer, nil
 }
 
 func (s3backer *s3backerMounter) String() string {
 	return path.Join(s3backer.meta.BucketName, s3backer.meta.Prefix)
 }
 
-func (s3backer s3backerMounter) Stage(stageTarget string) error {
-	// s3backer uses the loop device
-	if err := createLoopDevice(S3backerLoopDevice); err != nil {
-		return err
+// Stage fuse mounts the bucket as a single device file and mounts the
+// filesystem on it with the mount flags once, every target bind mounts it.
+// Raw block volumes are handed to the pods as the device itself.
+func (s3backer s3backerMounter) Stage(stageTarget string, mountFlags []string) error {
+	var options []string
+	if !s3backer.meta.Block {
+		fs := filesystems[FsType(s3backer.meta)]
+		flags := splitMountFlags(mountFlags)
+		if err := checkMountFlags(flags, fs.allowedFlags); err != nil {
+			return err
+		}
+		options = append(append([]string{}, fs.mountOptions...), flags...)
+	}
+	// the volume was expanded while unstaged
+	grow := s3backer.meta.DeviceBytes != 0 && s3backer.meta.CapacityBytes > s3backer.meta.DeviceBytes
+	var extraArgs []string
+	// --force is needed when the size no longer matches the one stored in the
+	// bucket, and after an unclean unmount left the mounted flag of the bucket
+	// set. The attachments of the volume already ensure a single node uses it.
+	if grow || s3backer.meta.Staged {
+		extraArgs = append(extraArgs, "--force")
 	}
 	// s3backer requires two mounts
 	// first mount will fuse mount the bucket to a single 'file'
-	if err := s3backer.mountInit(stageTarget); err != nil {
+	if err := s3backer.mountInit(stageTarget, extraArgs...); err != nil {
 		return err
 	}
-	// ensure 'file' device is formatted
-	err := formatFs(s3backerFsType, path.Join(stageTarget, s3backerDevice))
+	// ensure 'file' device is formatted, but never wipe an existing filesystem.
+	file := path.Join(stageTarget, s3backerDevice)
+	if !s3backer.meta.Block {
+		if err := prepareFs(FsType(s3backer.meta), file, s3backer.meta.Initialized, s3backer.meta.Staged); err != nil {
+			FuseUnmount(stageTarget)
+			return err
+		}
+	}
+	// the loop device is detached by Unstage
+	device, err := attachLoopDevice(file, false)
 	if err != nil {
 		FuseUnmount(stageTarget)
+		return err
 	}
-	return err
-}
-
-func (s3backer *s3backerMounter) Unstage(stageTarget string) error {
-	return FuseUnmount(stageTarget)
+	// raw block volumes are seen at their new size by the pods already
+	if s3backer.meta.Block {
+		return nil
+	}
+	// second mount will mount the loop device of the 'file' as a filesystem
+	if err := s3backer.mountFs(device, s3backerFsPath(stageTarget), options, grow); err != nil {
+		s3backer.Unstage(stageTarget)
+		return err
+	}
+	return nil
 }
 
-func (s3backer *s3backerMounter) Mount(source string, target string) error {
-	device := path.Join(source, s3backerDevice)
-	// second mount will mount the 'file' as a filesystem
-	err := mount.New("").Mount(device, target, s3backerFsType, []string{})
-	if err != nil {
-		// cleanup fuse mount
-		FuseUnmount(target)
+// mountFs mounts the filesystem on device at fsPath and grows it to the size
+// of device when grow is set, which is only possible while it is mounted.
+func (s3backer *s3backerMounter) mountFs(device string, fsPath string, options []string, grow bool) error {
+	if err := os.MkdirAll(fsPath, 0750); err != nil {
+		return err
+	}
+	fsType := FsType(s3backer.meta)
+	if err := mount.New("").Mount(device, fsPath, fsType, options); err != nil {
+		return err
+	}
+	if !grow {
+		return nil
+	}
+	if err := growFs(fsType, fsPath); err != nil {
 		return err
 	}
+	glog.Infof("Filesystem on %s grown to %d bytes", device, s3backer.meta.CapacityBytes)
 	return nil
 }
 
-func (s3backer *s3backerMounter) mountInit(p string) error {
-	args := []string{
-		fmt.Sprintf("--blockSize=%s", s3backerBlockSize),
-		fmt.Sprintf("--size=%v", s3backer.meta.CapacityBytes),
-		fmt.Sprintf("--prefix=%s/", path.Join(s3backer.meta.Prefix, s3backer.meta.FSPath)),
-		"--listBalocks",
-		s3backer.meta.BucketName,
-		p,
+// s3backerFsPath is where the filesystem of the volume staged at stagePath is
+// mounted. It cannot be below stagePath, the fuse mount only holds the device.
+func s3backerFsPath(stagePath string) string {
+	return filepath.Clean(stagePath) + ".fs"
+}
+
+// StagedPaths returns the paths the targets of a volume staged at stagePath
+// may be bind mounted from.
+func StagedPaths(stagePath string) []string {
+	return []string{stagePath, s3backerFsPath(stagePath)}
+}
+
+func (s3backer *s3backerMounter) Unstage(stageTarget string) error {
+	// the filesystem keeps the loop device busy, which keeps the fuse mount busy
+	if err := mount.CleanupMountPoint(s3backerFsPath(stageTarget), mount.New(""), true); err != nil {
+		return err
 	}
-	if s3backer.region != "" {
-		args = append(args, fmt.Sprintf("--region=%s", s3backer.region))
-	} else {
-		//only set baseURL if not on AWS (region is not set)
-		// baseURL must end with /
-		args = append(args, fmt.Sprintf("--baseURL=%s/", s3backer.url))
+	if err := detachLoopDevice(path.Join(stageTarget, s3backerDevice)); err != nil {
+		return err
 	}
-	if s3backer.ssl {
-		args = append(args, "--ssl")
+	// a cache left behind would be read when the volume comes back to this
+	// node, after another node may have changed its blocks
+	var files []string
+	if cacheFile := s3backer.blockCacheFile(stageTarget); cacheFile != "" {
+		files = append(files, cacheFile)
+	}
+	if err := fuseUnmount(stageTarget, files); err != nil {
+		return err
 	}
+	return RemoveCredentials(stageTarget)
+}
 
-	return fuseMount(p, s3backerCmd, args)
+// Mount bind mounts the filesystem mounted by Stage, the mount flags were
+// applied there. Only the targets can differ in being read-only, which
+// mounting the filesystem itself again would refuse.
+func (s3backer *s3backerMounter) Mount(source string, target string, opts PublishOptions) error {
+	if s3backer.meta.Block {
+		return s3backer.mountBlock(source, target, opts)
+	}
+	return bindMount(s3backerFsPath(source), target, opts.ReadOnly)
 }
 
-func (s3backer *s3backerMounter) writePasswd() error {
-	pwFileName := fmt.Sprintf("%s/.s3backer_passwd", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
+func (s3backer *s3backerMounter) mountBlock(source string, target string, opts PublishOptions) error {
+	if len(opts.MountFlags) > 0 {
+		return fmt.Errorf("%w: raw block volumes take no mount flags", ErrInvalidMountFlag)
+	}
+	device, err := attachLoopDevice(path.Join(source, s3backerDevice), opts.ReadOnly)
 	if err != nil {
 		return err
 	}
-	_, err = pwFile.WriteString(s3backer.accessKeyID + ":" + s3backer.secretAccessKey)
+	return bindMount(device, target, opts.ReadOnly)
+}
+
+// Expand only verifies that the staged device has the new size. s3backer
+// cannot resize a running device, the volume is grown when it is staged
+// again and the expansion stays pending until then.
+func (s3backer *s3backerMounter) Expand(stagePath string, target string) error {
+	info, err := os.Stat(path.Join(stagePath, s3backerDevice))
 	if err != nil {
 		return err
 	}
-	pwFile.Close()
+	if info.Size() < s3backer.meta.CapacityBytes {
+		return fmt.Errorf("volume staged at %s has %d bytes, it is only expanded to %d bytes when it is staged again",
+			stagePath, info.Size(), s3backer.meta.CapacityBytes)
+	}
 	return nil
 }
 
-func formatFs(fsType string, device string) error {
-	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
-	format, err := diskMounter.GetDiskFormat(device)
+// S3backerBlockSize returns the block size of an s3backer volume.
+func S3backerBlockSize(meta *s3.FSMeta) int64 {
+	if meta.S3backer == nil || meta.S3backer.BlockSize == 0 {
+		return s3backerLegacyBlockSize
+	}
+	return meta.S3backer.BlockSize
+}
+
+// blockCacheFile returns the persistent block cache of the mount at
+// stagePath, or an empty string when the cache is kept in memory. Its
+// directory is created by fuseMount, on the side running s3backer.
+func (s3backer *s3backerMounter) blockCacheFile(stagePath string) string {
+	o := s3backer.meta.S3backer
+	if o == nil || o.BlockCacheDir == "" {
+		return ""
+	}
+	return filepath.Join(o.BlockCacheDir, mountID(stagePath)+".cache")
+}
+
+// tuningArgs returns the arguments applying the cache, compression and
+// encryption settings of the volume to its mount at stagePath.
+func (s3backer *s3backerMounter) tuningArgs(stagePath string) ([]string, error) {
+	o := s3backer.meta.S3backer
+	if o == nil {
+		return nil, nil
+	}
+	var args []string
+	if o.BlockCacheSize > 0 {
+		args = append(args, fmt.Sprintf("--blockCacheSize=%d", o.BlockCacheSize))
+	}
+	if o.BlockCacheThreads > 0 {
+		args = append(args, fmt.Sprintf("--blockCacheThreads=%d", o.BlockCacheThreads))
+	}
+	if cacheFile := s3backer.blockCacheFile(stagePath); cacheFile != "" {
+		args = append(args, fmt.Sprintf("--blockCacheFile=%s", cacheFile))
+	}
+	if o.MD5CacheSize > 0 {
+		args = append(args, fmt.Sprintf("--md5CacheSize=%d", o.MD5CacheSize))
+	}
+	if o.MD5CacheTime > 0 {
+		args = append(args, fmt.Sprintf("--md5CacheTime=%d", o.MD5CacheTime))
+	}
+	if o.Compress {
+		args = append(args, "--compress")
+	}
+	if o.Encrypt {
+		if s3backer.encryptionKey == "" {
+			return nil, errors.New("the volume is encrypted but the secret has no encryptionKey")
+		}
+		keyFile, err := writeCredentials(stagePath, s3backerEncryptionFile, s3backer.encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--encrypt", fmt.Sprintf("--passwordFile=%s", keyFile))
+	}
+	return args, nil
+}
+
+func (s3backer *s3backerMounter) mountInit(p string, extraArgs ...string) error {
+	pwFile, err := writeCredentials(p, s3backerPasswdFile, s3backer.accessKeyID+":"+s3backer.secretAccessKey)
 	if err != nil {
 		return err
 	}
-	if format != "" {
-		glog.Infof("Disk %s is already formatted with format %s", device, format)
-	}
 	args := []string{
-		device,
+		fmt.Sprintf("--blockSize=%d", S3backerBlockSize(s3backer.meta)),
+		fmt.Sprintf("--size=%v", s3backer.meta.CapacityBytes),
+		fmt.Sprintf("--prefix=%s/", path.Join(s3backer.meta.Prefix, s3backer.meta.FSPath)),
+		"--listBlocks",
+		fmt.Sprintf("--accessFile=%s", pwFile),
+		s3backer.meta.BucketName,
+		p,
 	}
-	cmd := osexec.Command("mkfs."+fsType, args...)
-
-	out, err := cmd.CombinedOutput()
+	tuning, err := s3backer.tuningArgs(p)
 	if err != nil {
-		return fmt.Errorf("Error formatting disk: %s", out)
+		return err
 	}
-	glog.Infof("Formatting fs with type %s", fsType)
-	return nil
+	args = append(args, tuning...)
+	if s3backer.region != "" {
+		args = append(args, fmt.Sprintf("--region=%s", s3backer.region))
+	} else {
+		//only set baseURL if not on AWS (region is not set)
+		// baseURL must end with /
+		args = append(args, fmt.Sprintf("--baseURL=%s/", s3backer.url))
+	}
+	if s3backer.ssl {
+		args = append(args, "--ssl")
+	}
+	args = append(args, extraArgs...)
+
+	var dirs []string
+	if o := s3backer.meta.S3backer; o != nil && o.BlockCacheDir != "" {
+		dirs = append(dirs, o.BlockCacheDir)
+	}
+	return fuseMount(p, s3backerCmd, args, nil, dirs)
 }
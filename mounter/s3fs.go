@@ -3,11 +3,11 @@ package mounter
 import (
 	"CSI-test/pkg/s3"
 	"fmt"
-	"os"
 	"path"
 )
 
 type s3fsMounter struct {
+	sharedMount
 	meta          *s3.FSMeta
 	url           string
 	region        string
@@ -15,9 +15,19 @@ type s3fsMounter struct {
 }
 
 const (
-	s3fsCmd = "s3fs"
+	s3fsCmd        = "s3fs"
+	s3fsPasswdFile = "passwd-s3fs"
 )
 
+// s3fsAllowedFlags are the s3fs options that may be set through mountOptions
+var s3fsAllowedFlags = []string{
+	"ro", "uid", "gid", "umask", "mp_umask", "noatime", "nosuid", "nodev", "noexec",
+	"multipart_size", "parallel_count", "multireq_max", "max_dirty_data",
+	"stat_cache_expire", "stat_cache_interval_expire", "max_stat_cache_size", "enable_noobj_cache",
+	"list_object_max_keys", "retries", "connect_timeout", "readwrite_timeout",
+	"sigv2", "sigv4", "use_xattr", "dbglevel",
+}
+
 func newS3fsMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	return &s3fsMounter{
 		meta:          meta,
@@ -27,40 +37,39 @@ func newS3fsMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	}, nil
 }
 
-func (s3fs *s3fsMounter) Stage(stageTarget string) error {
-	return nil
-}
-
-func (s3fs *s3fsMounter) Unstage(stageTarget string) error {
-	return nil
-}
-
-func (s3fs *s3fsMounter) Mount(source string, target string) error {
-	if err := writes3fsPass(s3fs.pwFileContent); err != nil {
+// Stage mounts the volume at stageTarget, passing the credentials in a password file.
+func (s3fs *s3fsMounter) Stage(stageTarget string, mountFlags []string) error {
+	flags := splitMountFlags(mountFlags)
+	if err := checkMountFlags(flags, s3fsAllowedFlags); err != nil {
+		return err
+	}
+	pwFile, err := writeCredentials(stageTarget, s3fsPasswdFile, s3fs.pwFileContent)
+	if err != nil {
 		return err
 	}
 	args := []string{
 		fmt.Sprintf("%s:/%s", s3fs.meta.BucketName, path.Join(s3fs.meta.Prefix, s3fs.meta.FSPath)),
-		target,
+		stageTarget,
 		"-o", "use_path_request_style",
 		"-o", fmt.Sprintf("url=%s", s3fs.url),
 		"-o", fmt.Sprintf("endpoint=%s", s3fs.region),
 		"-o", "allow_other",
 		"-o", "mp_umask=000",
+		"-o", fmt.Sprintf("passwd_file=%s", pwFile),
 	}
-	return fuseMount(target, s3fsCmd, args)
-}
-
-func writes3fsPass(pwFileContent string) error {
-	pwFileName := fmt.Sprintf("%s/.passwd-s3fs", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+	for _, flag := range flags {
+		args = append(args, "-o", flag)
 	}
-	_, err = pwFile.WriteString(pwFileContent)
-	if err != nil {
+	if err := fuseMount(stageTarget, s3fsCmd, args, nil, nil); err != nil {
+		RemoveCredentials(stageTarget)
 		return err
 	}
-	pwFile.Close()
 	return nil
 }
+
+func (s3fs *s3fsMounter) Unstage(stageTarget string) error {
+	if err := FuseUnmount(stageTarget); err != nil {
+		return err
+	}
+	return RemoveCredentials(stageTarget)
+}
@@ -6,20 +6,28 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
+	"math"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	inFlight *inFlight
+	pools    *pools
+	usage    *usageCache
 }
 
 const (
@@ -36,9 +44,11 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	prefix := ""
 	usePrefix, usePrefixError := strconv.ParseBool(params[mounter.UsePrefix])
 	defaultFsPath := defaultFsPath
+	ownsBucket := true
 
 	// check if bucket name is overridden
 	if nameOverride, ok := params[mounter.BucketKey]; ok {
+		ownsBucket = false
 		bucketName = nameOverride
 		prefix = volumeID
 		volumeID = path.Join(bucketName, prefix)
@@ -68,6 +78,11 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	glog.V(4).Infof("Got a request to create volume %s", volumeID)
 
+	if !cs.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
+	}
+	defer cs.inFlight.delete(volumeID)
+
 	// prepare the metadata for the bucket.
 	meta := &s3.FSMeta{
 		BucketName:    bucketName,
@@ -76,13 +91,184 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		Mounter:       mounterType,
 		CapacityBytes: capacityBytes,
 		FSPath:        defaultFsPath,
+		OwnsBucket:    ownsBucket,
+	}
+
+	// raw block volumes expose the s3backer device, they cannot be mounted as well
+	for _, c := range req.GetVolumeCapabilities() {
+		if c.GetBlock() != nil {
+			meta.Block = true
+		}
+	}
+	if meta.Block {
+		for _, c := range req.GetVolumeCapabilities() {
+			if c.GetMount() != nil {
+				return nil, status.Error(codes.InvalidArgument, "block and mount access cannot be requested together")
+			}
+		}
+		if _, ok := params[mounter.FsTypeKey]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is not supported for raw block volumes", mounter.FsTypeKey)
+		}
+	}
+
+	// only the block device image of s3backer holds a filesystem of its own,
+	// the other mounters ignore the fsType of the volume capabilities
+	fsType := params[mounter.FsTypeKey]
+	if fsType != "" && !mounter.IsBlockMounter(mounterType) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is not supported by mounter %q", mounter.FsTypeKey, mounterType)
+	}
+	if mounter.IsBlockMounter(mounterType) {
+		for _, c := range req.GetVolumeCapabilities() {
+			if fs := c.GetMount().GetFsType(); fs != "" {
+				if fsType != "" && fs != fsType {
+					return nil, status.Errorf(codes.InvalidArgument, "conflicting filesystem types %q and %q requested", fsType, fs)
+				}
+				fsType = fs
+			}
+		}
 	}
+	if fsType != "" {
+		if err := mounter.ValidateFsType(fsType); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		meta.FsType = fsType
+	}
+	s3backerOptions, err := s3backerOptionsFromParams(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s3backerOptions != nil && !mounter.IsBlockMounter(mounterType) {
+		return nil, status.Errorf(codes.InvalidArgument, "s3backer parameters are not supported by mounter %q", mounterType)
+	}
+	if mounter.IsBlockMounter(mounterType) {
+		if s3backerOptions == nil {
+			s3backerOptions = &s3.S3backerOptions{}
+		}
+		// record the block size, so changing the default cannot affect existing volumes
+		if s3backerOptions.BlockSize == 0 {
+			s3backerOptions.BlockSize = mounter.S3backerDefaultBlockSize
+		}
+		meta.S3backer = s3backerOptions
+	}
+
+	// only grant the access modes the chosen mounter can serve
+	var accessModes []string
+	for _, c := range req.GetVolumeCapabilities() {
+		if err := validateVolumeCapability(cs.Driver, meta, c); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume capability: %v", err)
+		}
+		accessModes = append(accessModes, c.GetAccessMode().GetMode().String())
+	}
+	meta.AccessModes = accessModes
 
 	client, err := s3.NewClientFromSecret(req.GetSecrets())
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
 
+	// locate the data a cloned or restored volume is populated from
+	contentSource := req.GetVolumeContentSource()
+	var srcBucket, srcPrefix string
+	var srcMeta *s3.FSMeta
+	switch {
+	case contentSource.GetVolume() != nil:
+		if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CLONE_VOLUME); err != nil {
+			return nil, err
+		}
+		srcVolumeID := contentSource.GetVolume().GetVolumeId()
+		bucket, p := volumeIDToBucketPrefix(srcVolumeID)
+		m, err := client.GetFSMeta(bucket, p)
+		if err != nil {
+			if s3.IsNotExist(err) {
+				return nil, status.Errorf(codes.NotFound, "source volume %s not found", srcVolumeID)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to get metadata of volume %s: %v", srcVolumeID, err)
+		}
+		srcBucket, srcPrefix, srcMeta = bucket, path.Join(p, m.FSPath), m
+	case contentSource.GetSnapshot() != nil:
+		if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+			return nil, err
+		}
+		snapshotID := contentSource.GetSnapshot().GetSnapshotId()
+		bucket, name, ok := snapshotIDToBucketName(snapshotID)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "source snapshot %s not found", snapshotID)
+		}
+		snap, err := client.GetSnapshotMeta(bucket, name)
+		if err != nil {
+			if s3.IsNotExist(err) {
+				return nil, status.Errorf(codes.NotFound, "source snapshot %s not found", snapshotID)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to get metadata of snapshot %s: %v", snapshotID, err)
+		}
+		if !snap.ReadyToUse {
+			return nil, status.Errorf(codes.Unavailable, "source snapshot %s is not ready to use", snapshotID)
+		}
+		srcBucket, srcPrefix, srcMeta = bucket, snap.DataPrefix(), &snap.Volume
+	}
+	if srcMeta != nil {
+		// the device of a raw block volume holds no filesystem to mount, and
+		// formatting would wipe it
+		if meta.Block != srcMeta.Block {
+			return nil, status.Error(codes.InvalidArgument,
+				"raw block and filesystem volumes cannot be populated from each other")
+		}
+		// the copied block device image already holds the filesystem of the
+		// source, which is only crash consistent when the source was staged
+		meta.Initialized = srcMeta.Initialized
+		meta.Staged = srcMeta.Staged
+		if mounter.IsBlockMounter(mounterType) {
+			if fsType != "" && fsType != mounter.FsType(srcMeta) {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"cannot populate a %s volume from a %s volume", fsType, mounter.FsType(srcMeta))
+			}
+			meta.FsType = srcMeta.FsType
+			if err := inheritS3backerOptions(meta, srcMeta, params); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+		if !mounter.SameDataLayout(mounterType, srcMeta.Mounter) {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"cannot populate a %q volume from a %q volume", mounterType, srcMeta.Mounter)
+		}
+		if capacityBytes == 0 {
+			capacityBytes = srcMeta.CapacityBytes
+			meta.CapacityBytes = capacityBytes
+		}
+		if capacityBytes < srcMeta.CapacityBytes {
+			return nil, status.Errorf(codes.OutOfRange,
+				"requested capacity %d is smaller than the source capacity %d", capacityBytes, srcMeta.CapacityBytes)
+		}
+		// the copied block device image keeps the size of the source, a larger
+		// volume is grown when it is staged the first time
+		if mounter.NeedsNodeExpansion(meta) {
+			meta.DeviceBytes = srcMeta.DeviceBytes
+			if meta.DeviceBytes == 0 && (srcMeta.Initialized || srcMeta.Block) {
+				meta.DeviceBytes = srcMeta.CapacityBytes
+			}
+		}
+	}
+
+	// keep the volumes of the StorageClass within its pool
+	pool, poolSize, err := poolFromParams(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	created := false
+	if poolSize > 0 {
+		meta.Pool, meta.PoolSize = pool, poolSize
+		undo, err := cs.pools.reserve(pool, volumeID, capacityBytes, poolSize, poolLister(client, params[mounter.BucketKey]))
+		if err != nil {
+			return nil, err
+		}
+		// a failed attempt must not hold on to the capacity
+		defer func() {
+			if !created {
+				undo()
+			}
+		}()
+	}
+
 	exists, err := client.BucketExists(bucketName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check if bucket %s exists: %v", volumeID, err)
@@ -92,6 +278,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		// what does this mean?
 		// if bucket exists, get metadata of the bucket, ignore errors as it could just mean meta does not exist yet
 		m, err := client.GetFSMeta(bucketName, prefix)
+		ownedBefore := err == nil && m.OwnsBucket
 		if err == nil {
 			// Check if volume capacity requested is bigger than the already existing capacity
 			if capacityBytes > m.CapacityBytes {
@@ -99,39 +286,777 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 					codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with smaller size already exist", volumeID),
 				)
 			}
+			// a retry must not forget that the volume was formatted in the meantime
+			meta.Initialized = meta.Initialized || m.Initialized
+			// the blocks already written cannot be read with another block size
+			if m.Initialized && mounter.IsBlockMounter(m.Mounter) && mounter.S3backerBlockSize(m) != mounter.S3backerBlockSize(meta) {
+				return nil, status.Errorf(codes.AlreadyExists,
+					"volume %s already exists with block size %d", volumeID, mounter.S3backerBlockSize(m))
+			}
+		}
+		// a retry finds the bucket created by the first attempt
+		if ownsBucket && !ownedBefore {
+			if ownsBucket, err = client.IsBucketOwned(bucketName); err != nil {
+				return nil, fmt.Errorf("failed to check owner of bucket %s: %v", bucketName, err)
+			}
 		}
 	} else {
 		if err = client.CreateBucket(bucketName); err != nil {
 			return nil, fmt.Errorf("failed to create bucket %s: %v", bucketName, err)
 		}
+		if ownsBucket {
+			if err := client.MarkBucketOwned(bucketName); err != nil {
+				// a retry could not tell the bucket apart from a foreign one
+				client.RemoveBucket(bucketName)
+				return nil, fmt.Errorf("failed to mark bucket %s as owned: %v", bucketName, err)
+			}
+		}
 	}
+	// only a bucket created for the volume may be removed with it
+	meta.OwnsBucket = ownsBucket
 
 	if err = client.CreatePrefix(bucketName, path.Join(prefix, defaultFsPath)); err != nil && prefix != "" {
-		return nil, fmt.Errorf("failed to create prefix %s: %v", path.Join(prefix, defaultFsPath))
+		return nil, fmt.Errorf("failed to create prefix %s: %v", path.Join(prefix, defaultFsPath), err)
+	}
+
+	// copy the source before writing the metadata, so a volume is never visible half populated
+	if srcMeta != nil {
+		if err := client.CopyPrefix(srcBucket, srcPrefix, bucketName, path.Join(prefix, defaultFsPath)); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to populate volume %s: %v", volumeID, err)
+		}
 	}
 
 	if err := client.SetFSMeta(meta); err != nil {
 		return nil, fmt.Errorf("error setting bucket metadata: %w", err)
 	}
 
+	created = true
 	glog.V(4).Infof("create volume %s", volumeID)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
 			CapacityBytes: capacityBytes,
 			VolumeContext: req.GetParameters(),
+			ContentSource: contentSource,
 		},
 	}, nil
 
 }
 
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		glog.V(3).Infof("Invalid delete volume req: %v", req)
+		return nil, err
+	}
+
+	if !cs.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
+	}
+	defer cs.inFlight.delete(volumeID)
+	glog.V(4).Infof("Deleting volume %s", volumeID)
+
+	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize S3 client: %s", err)
+	}
+
+	exists, err := client.BucketExists(bucketName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if bucket %s exists: %v", bucketName, err)
+	}
+	if !exists {
+		glog.V(4).Infof("Bucket %s does not exist, volume %s is already deleted", bucketName, volumeID)
+		cs.pools.release(volumeID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	// A missing metadata object means an earlier call already got past it,
+	// only the remaining objects of an owned bucket have to be cleaned up. The
+	// bucket still tells whether it was created for the volume then. Without
+	// metadata nothing tells the objects of a shared bucket apart from those
+	// of other volumes, so they are left alone.
+	var ownsBucket bool
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	switch {
+	case err == nil:
+		ownsBucket = meta.OwnsBucket
+	case s3.IsNotExist(err):
+		if ownsBucket, err = client.IsBucketOwned(bucketName); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check owner of bucket %s: %v", bucketName, err)
+		}
+		if !ownsBucket {
+			glog.V(4).Infof("Volume %s has no metadata in bucket %s, it is already deleted", volumeID, bucketName)
+			cs.pools.release(volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+	default:
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of volume %s: %v", volumeID, err)
+	}
+
+	// the root of a shared bucket holds the objects of others as well
+	if prefix != "" || ownsBucket {
+		if err := client.RemovePrefix(bucketName, prefix); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove prefix %s of volume %s: %v", prefix, volumeID, err)
+		}
+	} else {
+		glog.Warningf("Volume %s is the root of bucket %s it does not own, keeping its objects", volumeID, bucketName)
+	}
+	// the metadata must go before the bucket can, record the decision in the
+	// bucket first, volumes created before the tag existed lack it
+	if ownsBucket {
+		if err := client.MarkBucketOwned(bucketName); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to mark bucket %s as owned: %v", bucketName, err)
+		}
+	}
+	if err := client.RemoveFSMeta(bucketName, prefix); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove metadata of volume %s: %v", volumeID, err)
+	}
+
+	// never remove a bucket the volume only borrowed through the bucket parameter
+	if ownsBucket {
+		err := client.RemoveBucket(bucketName)
+		switch {
+		case s3.IsBucketNotEmpty(err):
+			// snapshots of the volume are still stored in the bucket
+			glog.V(4).Infof("Bucket %s still holds snapshots, keeping it", bucketName)
+		case err != nil:
+			return nil, status.Errorf(codes.Internal, "failed to remove bucket %s: %v", bucketName, err)
+		default:
+			glog.V(4).Infof("Bucket %s removed", bucketName)
+		}
+	}
+
+	cs.pools.release(volumeID)
+	cs.usage.forget(volumeID)
+	glog.V(4).Infof("Volume %s deleted", volumeID)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(nodeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capability missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		glog.V(3).Infof("Invalid publish volume req: %v", req)
+		return nil, err
+	}
+
+	if !cs.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
+	}
+	defer cs.inFlight.delete(volumeID)
+
+	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize S3 client: %s", err)
+	}
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		if s3.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of volume %s: %v", volumeID, err)
+	}
+	if err := validateVolumeCapability(cs.Driver, meta, req.GetVolumeCapability()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume capability: %v", err)
+	}
+
+	attachments, etag, err := client.GetAttachments(bucketName, prefix)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get attachments of volume %s: %v", volumeID, err)
+	}
+
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	attachment := s3.Attachment{
+		AccessMode: mode.String(),
+		ReadOnly:   req.GetReadonly(),
+		Time:       time.Now().UTC(),
+	}
+	publishContext := map[string]string{publishNodeKey: nodeID}
+
+	if existing, ok := attachments.Nodes[nodeID]; ok {
+		if existing.AccessMode != attachment.AccessMode || existing.ReadOnly != attachment.ReadOnly {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s is already published to node %s with a different capability", volumeID, nodeID)
+		}
+		return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+	}
+
+	for otherNode, other := range attachments.Nodes {
+		if attachmentsConflict(meta, attachment, other) {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already published to node %s", volumeID, otherNode)
+		}
+	}
+
+	attachments.Nodes[nodeID] = attachment
+	if err := client.SetAttachments(bucketName, prefix, attachments, etag); err != nil {
+		if s3.IsConflict(err) {
+			return nil, status.Errorf(codes.Aborted, "attachments of volume %s changed concurrently", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to set attachments of volume %s: %v", volumeID, err)
+	}
+
+	glog.V(4).Infof("Volume %s published to node %s", volumeID, nodeID)
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+}
+
+func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		glog.V(3).Infof("Invalid unpublish volume req: %v", req)
+		return nil, err
+	}
+
+	if !cs.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
+	}
+	defer cs.inFlight.delete(volumeID)
+
+	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize S3 client: %s", err)
+	}
+	attachments, etag, err := client.GetAttachments(bucketName, prefix)
+	if err != nil {
+		if s3.IsNotExist(err) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get attachments of volume %s: %v", volumeID, err)
+	}
+
+	// an empty node ID unpublishes the volume from all nodes
+	if nodeID == "" {
+		attachments.Nodes = nil
+	} else if _, ok := attachments.Nodes[nodeID]; ok {
+		delete(attachments.Nodes, nodeID)
+	} else {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	if err := client.SetAttachments(bucketName, prefix, attachments, etag); err != nil {
+		if s3.IsConflict(err) {
+			return nil, status.Errorf(codes.Aborted, "attachments of volume %s changed concurrently", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to set attachments of volume %s: %v", volumeID, err)
+	}
+
+	glog.V(4).Infof("Volume %s unpublished from node %s", volumeID, nodeID)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
+	}
+
+	client, err := s3.NewClientFromSecretOrEnv(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to initialize S3 client: %s", err)
+	}
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		if s3.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of volume %s: %v", volumeID, err)
+	}
+
+	for _, c := range req.GetVolumeCapabilities() {
+		if err := validateVolumeCapability(cs.Driver, meta, c); err != nil {
+			glog.V(4).Infof("Volume %s does not support capability %v: %v", volumeID, c, err)
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return &csi.ControllerExpandVolumeResponse{}, status.Error(codes.Unimplemented, "ControllerExpandVolume is not implemented")
+	volumeID := req.GetVolumeId()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		glog.V(3).Infof("Invalid expand volume req: %v", req)
+		return nil, err
+	}
+
+	if !cs.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
+	}
+	defer cs.inFlight.delete(volumeID)
+
+	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize S3 client: %s", err)
+	}
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		if s3.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of volume %s: %v", volumeID, err)
+	}
+
+	// only the s3backer block device has to be grown on the node, raw block
+	// volumes included
+	nodeExpansionRequired := mounter.NeedsNodeExpansion(meta)
+
+	if capacityBytes <= meta.CapacityBytes {
+		glog.V(4).Infof("Volume %s already has capacity %d, requested %d", volumeID, meta.CapacityBytes, capacityBytes)
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         meta.CapacityBytes,
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
 
+	// the volume has to stay within the pool it was created in
+	undo := func() {}
+	if meta.PoolSize > 0 {
+		// only volumes of a StorageClass with a bucket parameter share a bucket
+		bucket := ""
+		if !meta.OwnsBucket {
+			bucket = meta.BucketName
+		}
+		if undo, err = cs.pools.reserve(meta.Pool, volumeID, capacityBytes, meta.PoolSize, poolLister(client, bucket)); err != nil {
+			return nil, err
+		}
+	}
+
+	// the node may record flags in the metadata meanwhile, never overwrite them
+	_, err = client.UpdateFSMeta(bucketName, prefix, func(meta *s3.FSMeta) bool {
+		if capacityBytes <= meta.CapacityBytes {
+			return false
+		}
+		meta.CapacityBytes = capacityBytes
+		return true
+	})
+	if err != nil {
+		undo()
+		return nil, status.Errorf(codes.Internal, "error setting bucket metadata: %v", err)
+	}
+
+	glog.V(4).Infof("Volume %s expanded to %d bytes", volumeID, capacityBytes)
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacityBytes,
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
+}
+
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		glog.V(3).Infof("Invalid list volumes req: %v", req)
+		return nil, err
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+	// the token is the last volume returned, which stays valid while volumes
+	// are created and deleted, unlike an index into the list
+	afterBucket, afterPrefix := volumeIDToBucketPrefix(req.GetStartingToken())
+
+	client, err := s3.NewClientFromEnv()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to initialize S3 client: %s", err)
+	}
+	metas, more, err := client.ListFSMetaAfter(afterBucket, afterPrefix, int(req.GetMaxEntries()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list volumes: %v", err)
+	}
+	nextToken := ""
+	if more {
+		last := metas[len(metas)-1]
+		nextToken = volumeIDFromMeta(last)
+	}
+
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, meta := range metas {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      volumeIDFromMeta(meta),
+				CapacityBytes: meta.CapacityBytes,
+				VolumeContext: volumeContextFromMeta(meta),
+			},
+		})
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	sourceVolumeID := req.GetSourceVolumeId()
+	bucketName, prefix := volumeIDToBucketPrefix(sourceVolumeID)
+
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(sourceVolumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.V(3).Infof("Invalid create snapshot req: %v", req)
+		return nil, err
+	}
+
+	snapshotName := sanitizeVolumeID(req.GetName())
+	glog.V(4).Infof("Got a request to create snapshot %s of volume %s", snapshotName, sourceVolumeID)
+
+	// the source must not be deleted while its objects are copied
+	snapshotID := path.Join(bucketName, s3.SnapshotPrefix(snapshotName))
+	if !cs.inFlight.insert(snapshotID, sourceVolumeID) {
+		return nil, errInFlight(snapshotID)
+	}
+	defer cs.inFlight.delete(snapshotID, sourceVolumeID)
+
+	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize S3 client: %s", err)
+	}
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		if s3.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "source volume %s not found", sourceVolumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of volume %s: %v", sourceVolumeID, err)
+	}
+
+	snap, err := client.GetSnapshotMeta(bucketName, snapshotName)
+	switch {
+	case err == nil && snap.SourceVolumeID != sourceVolumeID:
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", snapshotName, snap.SourceVolumeID)
+	case err == nil && snap.ReadyToUse:
+		return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snap)}, nil
+	case err == nil:
+		// an earlier attempt was interrupted, start the copy over
+		if err := client.RemovePrefix(bucketName, snap.DataPrefix()); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to clean up snapshot %s: %v", snapshotName, err)
+		}
+	case s3.IsNotExist(err):
+		snap = &s3.SnapshotMeta{
+			Name:           snapshotName,
+			BucketName:     bucketName,
+			SourceVolumeID: sourceVolumeID,
+			CreationTime:   time.Now().UTC(),
+		}
+	default:
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of snapshot %s: %v", snapshotName, err)
+	}
+	snap.Volume = *meta
+	snap.ReadyToUse = false
+
+	// record the snapshot before copying so an interrupted copy can be found and resumed
+	if err := client.SetSnapshotMeta(snap); err != nil {
+		return nil, status.Errorf(codes.Internal, "error setting snapshot metadata: %v", err)
+	}
+	if err := client.CopyPrefix(bucketName, path.Join(prefix, meta.FSPath), bucketName, snap.DataPrefix()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to copy volume %s to snapshot %s: %v", sourceVolumeID, snapshotName, err)
+	}
+	snap.ReadyToUse = true
+	if err := client.SetSnapshotMeta(snap); err != nil {
+		return nil, status.Errorf(codes.Internal, "error setting snapshot metadata: %v", err)
+	}
+
+	glog.V(4).Infof("Snapshot %s of volume %s created", snapshotName, sourceVolumeID)
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snap)}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotID := req.GetSnapshotId()
+
+	// Check arguments
+	if len(snapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.V(3).Infof("Invalid delete snapshot req: %v", req)
+		return nil, err
+	}
+
+	if !cs.inFlight.insert(snapshotID) {
+		return nil, errInFlight(snapshotID)
+	}
+	defer cs.inFlight.delete(snapshotID)
+
+	bucketName, snapshotName, ok := snapshotIDToBucketName(snapshotID)
+	if !ok {
+		// the snapshot cannot have been created by this driver
+		glog.V(4).Infof("Snapshot ID %s is invalid, assuming it is already deleted", snapshotID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize S3 client: %s", err)
+	}
+	exists, err := client.BucketExists(bucketName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if bucket %s exists: %v", bucketName, err)
+	}
+	if !exists {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	snap, err := client.GetSnapshotMeta(bucketName, snapshotName)
+	if err != nil && !s3.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of snapshot %s: %v", snapshotName, err)
+	}
+	if err := client.RemoveSnapshot(bucketName, snapshotName); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove snapshot %s: %v", snapshotName, err)
+	}
+
+	// the last snapshot of an already deleted volume may be all that kept its bucket
+	if snap != nil && snap.Volume.OwnsBucket {
+		if _, err := client.GetFSMeta(bucketName, snap.Volume.Prefix); s3.IsNotExist(err) {
+			if err := client.RemoveBucket(bucketName); err != nil && !s3.IsBucketNotEmpty(err) {
+				return nil, status.Errorf(codes.Internal, "failed to remove bucket %s: %v", bucketName, err)
+			}
+		}
+	}
+
+	glog.V(4).Infof("Snapshot %s deleted", snapshotID)
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		glog.V(3).Infof("Invalid list snapshots req: %v", req)
+		return nil, err
+	}
+	start, err := parseStartingToken(req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s3.NewClientFromSecretOrEnv(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to initialize S3 client: %s", err)
+	}
+
+	var snaps []*s3.SnapshotMeta
+	switch {
+	case req.GetSnapshotId() != "":
+		bucketName, snapshotName, ok := snapshotIDToBucketName(req.GetSnapshotId())
+		if !ok {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		snap, err := client.GetSnapshotMeta(bucketName, snapshotName)
+		if err != nil && !s3.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "failed to get metadata of snapshot %s: %v", snapshotName, err)
+		}
+		if snap != nil && (req.GetSourceVolumeId() == "" || req.GetSourceVolumeId() == snap.SourceVolumeID) {
+			snaps = append(snaps, snap)
+		}
+	case req.GetSourceVolumeId() != "":
+		bucketName, _ := volumeIDToBucketPrefix(req.GetSourceVolumeId())
+		found, err := client.ListSnapshotMeta(bucketName)
+		if err != nil && !s3.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "failed to list snapshots: %v", err)
+		}
+		for _, snap := range found {
+			if snap.SourceVolumeID == req.GetSourceVolumeId() {
+				snaps = append(snaps, snap)
+			}
+		}
+	default:
+		buckets, err := client.ListBuckets()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list buckets: %v", err)
+		}
+		for _, bucketName := range buckets {
+			found, err := client.ListSnapshotMeta(bucketName)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to list snapshots: %v", err)
+			}
+			snaps = append(snaps, found...)
+		}
+	}
+
+	end, nextToken, err := paginate(start, req.GetMaxEntries(), len(snaps))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snap := range snaps[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(snap)})
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	params := req.GetParameters()
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		glog.V(3).Infof("Invalid get capacity req: %v", req)
+		return nil, err
+	}
+
+	meta := &s3.FSMeta{Mounter: params[mounter.TypeKey]}
+	for _, c := range req.GetVolumeCapabilities() {
+		if err := validateVolumeCapability(cs.Driver, meta, c); err != nil {
+			glog.V(4).Infof("No capacity for capability %v: %v", c, err)
+			return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+		}
+	}
+
+	pool, poolSize, err := poolFromParams(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// without a pool the capacity is only bounded by the S3 backend
+	if poolSize == 0 {
+		return &csi.GetCapacityResponse{AvailableCapacity: math.MaxInt64}, nil
+	}
+
+	client, err := s3.NewClientFromEnv()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to initialize S3 client: %s", err)
+	}
+	used, err := cs.pools.used(pool, poolLister(client, params[mounter.BucketKey]))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to compute used capacity: %v", err)
+	}
+
+	available := poolSize - used
+	if available < 0 {
+		available = 0
+	}
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
 }
 
 func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return &csi.ControllerGetVolumeResponse{}, status.Error(codes.Unimplemented, "ControllerGetVolume is not implemented")
+	volumeID := req.GetVolumeId()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		glog.V(3).Infof("Invalid get volume req: %v", req)
+		return nil, err
+	}
+
+	client, err := s3.NewClientFromEnv()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to initialize S3 client: %s", err)
+	}
+
+	volume := &csi.Volume{VolumeId: volumeID}
+	abnormal := func(format string, a ...interface{}) (*csi.ControllerGetVolumeResponse, error) {
+		message := fmt.Sprintf(format, a...)
+		glog.V(4).Infof("Volume %s is abnormal: %s", volumeID, message)
+		return &csi.ControllerGetVolumeResponse{
+			Volume: volume,
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: message},
+			},
+		}, nil
+	}
+
+	// this is the health probe of the volume and called often, reading the
+	// metadata shows the volume is reachable, its objects are listed rarely
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		if s3.IsBucketNotExist(err) {
+			return abnormal("bucket %s does not exist", bucketName)
+		}
+		return abnormal("metadata of the volume is unreadable: %v", err)
+	}
+	volume.CapacityBytes = meta.CapacityBytes
+	volume.VolumeContext = volumeContextFromMeta(meta)
+
+	attachments, _, err := client.GetAttachments(bucketName, prefix)
+	if err != nil {
+		return abnormal("attachments of the volume are unreadable: %v", err)
+	}
+	var publishedNodes []string
+	for node := range attachments.Nodes {
+		publishedNodes = append(publishedNodes, node)
+	}
+	sort.Strings(publishedNodes)
+
+	// the objects of a block device image always add up to its capacity, only
+	// the files of the other mounters can exceed it
+	condition := &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	if !mounter.IsBlockMounter(meta.Mounter) && meta.CapacityBytes > 0 {
+		used, err := cs.usage.get(volumeID, func() (int64, error) {
+			used, _, err := client.PrefixUsage(bucketName, path.Join(prefix, meta.FSPath))
+			return used, err
+		})
+		switch {
+		case err != nil:
+			condition = &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("failed to list the volume contents: %v", err)}
+		case used > meta.CapacityBytes:
+			condition = &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume uses %d bytes, more than its capacity of %d bytes", used, meta.CapacityBytes)}
+		}
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodes,
+			VolumeCondition:  condition,
+		},
+	}, nil
 }
 
 // generate volumeID from req.Name
@@ -145,11 +1070,327 @@ func sanitizeVolumeID(volumeID string) string {
 	return volumeID
 }
 
+// validateVolumeCapability checks the access type and mode of c against what
+// the driver and the mounter of the volume support, and against the access
+// modes the volume was created with.
+func validateVolumeCapability(d *csicommon.CSIDriver, meta *s3.FSMeta, c *csi.VolumeCapability) error {
+	if c.GetBlock() != nil {
+		if !mounter.IsBlockMounter(meta.Mounter) {
+			return fmt.Errorf("block access is not supported by mounter %q", meta.Mounter)
+		}
+		if !meta.Block {
+			return errors.New("block access was not requested when creating the volume")
+		}
+	} else if c.GetMount() == nil {
+		return errors.New("access type missing in volume capability")
+	} else if meta.Block {
+		return errors.New("raw block volumes cannot be mounted as a filesystem")
+	}
+
+	mode := c.GetAccessMode().GetMode()
+	supported := false
+	for _, m := range d.GetVolumeCapabilityAccessModes() {
+		if m.GetMode() == mode {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("access mode %s is not supported", mode)
+	}
+	if fs := c.GetMount().GetFsType(); fs != "" && mounter.IsBlockMounter(meta.Mounter) && fs != mounter.FsType(meta) {
+		return fmt.Errorf("filesystem type %q does not match the %q filesystem of the volume", fs, mounter.FsType(meta))
+	}
+	if isMultiNodeAccessMode(mode) && !mounter.SupportsMultiNode(meta.Mounter) {
+		return fmt.Errorf("access mode %s is not supported by mounter %q", mode, meta.Mounter)
+	}
+	// volumes created before access modes were recorded accept any supported mode
+	if len(meta.AccessModes) > 0 && !hasEquivalentAccessMode(meta, mode) {
+		return fmt.Errorf("access mode %s was not requested when creating the volume", mode)
+	}
+	return nil
+}
+
+// singleNodeWriterModes are the modes ReadWriteOnce is translated to. The
+// provisioner and the kubelet pick different ones depending on the controller
+// and node capabilities, so they are interchangeable for a granted mode.
+var singleNodeWriterModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
+
+// hasEquivalentAccessMode reports whether mode, or a mode equivalent to it,
+// was granted to the volume.
+func hasEquivalentAccessMode(meta *s3.FSMeta, mode csi.VolumeCapability_AccessMode_Mode) bool {
+	if meta.HasAccessMode(mode.String()) {
+		return true
+	}
+	if !isSingleNodeWriterMode(mode) {
+		return false
+	}
+	for _, m := range singleNodeWriterModes {
+		if meta.HasAccessMode(m.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSingleNodeWriterMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, m := range singleNodeWriterModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentsConflict reports whether a volume may not be attached to another
+// node while it is already attached to a node with the other attachment.
+func attachmentsConflict(meta *s3.FSMeta, attachment s3.Attachment, other s3.Attachment) bool {
+	mode := csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[attachment.AccessMode])
+	otherMode := csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[other.AccessMode])
+	if !mounter.SupportsMultiNode(meta.Mounter) || !isMultiNodeAccessMode(mode) || !isMultiNodeAccessMode(otherMode) {
+		return true
+	}
+	// a single writer may share the volume with readers only
+	if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+		return false
+	}
+	return isWriterAttachment(attachment) && isWriterAttachment(other)
+}
+
+func isWriterAttachment(attachment s3.Attachment) bool {
+	return !attachment.ReadOnly && attachment.AccessMode != csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY.String() &&
+		attachment.AccessMode != csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY.String()
+}
+
+func isMultiNodeAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseCapacity parses a size in bytes with an optional binary suffix such as
+// Mi or Gi. An empty string is a size of 0.
+func parseCapacity(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for i, suffix := range []string{"Ki", "Mi", "Gi", "Ti", "Pi"} {
+		if strings.HasSuffix(size, suffix) {
+			size = strings.TrimSuffix(size, suffix)
+			multiplier = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %s out of range", size)
+	}
+	return value * multiplier, nil
+}
+
+// s3backerOptionsFromParams returns the s3backer tuning set in the
+// StorageClass parameters, or nil when none is set.
+func s3backerOptionsFromParams(params map[string]string) (*s3.S3backerOptions, error) {
+	o := &s3.S3backerOptions{}
+	set := false
+	for key, value := range map[string]*int{
+		mounter.BlockCacheSizeKey:    &o.BlockCacheSize,
+		mounter.BlockCacheThreadsKey: &o.BlockCacheThreads,
+		mounter.MD5CacheSizeKey:      &o.MD5CacheSize,
+		mounter.MD5CacheTimeKey:      &o.MD5CacheTime,
+	} {
+		if v, ok := params[key]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s parameter %q", key, v)
+			}
+			*value, set = n, true
+		}
+	}
+	for key, value := range map[string]*bool{
+		mounter.CompressKey: &o.Compress,
+		mounter.EncryptKey:  &o.Encrypt,
+	} {
+		if v, ok := params[key]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s parameter %q", key, v)
+			}
+			*value, set = b, true
+		}
+	}
+	if v, ok := params[mounter.BlockSizeKey]; ok {
+		size, err := parseCapacity(v)
+		// s3backer needs a power of two of at least one sector
+		if err != nil || size < 512 || size&(size-1) != 0 {
+			return nil, fmt.Errorf("invalid %s parameter %q, it must be a power of two of at least 512 bytes", mounter.BlockSizeKey, v)
+		}
+		o.BlockSize, set = size, true
+	}
+	if v, ok := params[mounter.BlockCacheDirKey]; ok {
+		if !path.IsAbs(v) {
+			return nil, fmt.Errorf("invalid %s parameter %q, it must be an absolute path", mounter.BlockCacheDirKey, v)
+		}
+		o.BlockCacheDir, set = v, true
+	}
+	if o.BlockCacheDir != "" && o.BlockCacheSize == 0 {
+		return nil, fmt.Errorf("%s requires %s", mounter.BlockCacheDirKey, mounter.BlockCacheSizeKey)
+	}
+	if !set {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// inheritS3backerOptions gives a volume populated from srcMeta the settings
+// its data was stored with, rejecting explicit parameters conflicting with them.
+func inheritS3backerOptions(meta *s3.FSMeta, srcMeta *s3.FSMeta, params map[string]string) error {
+	src := srcMeta.S3backer
+	if src == nil {
+		src = &s3.S3backerOptions{}
+	}
+	blockSize := mounter.S3backerBlockSize(srcMeta)
+	if _, ok := params[mounter.BlockSizeKey]; ok && meta.S3backer.BlockSize != blockSize {
+		return fmt.Errorf("block size %d differs from the block size %d of the source", meta.S3backer.BlockSize, blockSize)
+	}
+	if _, ok := params[mounter.CompressKey]; ok && meta.S3backer.Compress != src.Compress {
+		return errors.New("compression differs from the source")
+	}
+	if _, ok := params[mounter.EncryptKey]; ok && meta.S3backer.Encrypt != src.Encrypt {
+		return errors.New("encryption differs from the source")
+	}
+	meta.S3backer.BlockSize = blockSize
+	meta.S3backer.Compress = src.Compress
+	meta.S3backer.Encrypt = src.Encrypt
+	return nil
+}
+
+// parseStartingToken returns the index a paginated list call starts at.
+func parseStartingToken(token string, maxEntries int32) (int, error) {
+	if maxEntries < 0 {
+		return 0, status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+	if token == "" {
+		return 0, nil
+	}
+	start, err := strconv.Atoi(token)
+	if err != nil || start < 0 {
+		return 0, status.Errorf(codes.Aborted, "invalid starting_token %q", token)
+	}
+	return start, nil
+}
+
+// paginate returns the end of the page starting at start and the token of the next page.
+func paginate(start int, maxEntries int32, total int) (int, string, error) {
+	if start > total {
+		return 0, "", status.Errorf(codes.Aborted, "starting_token %d is out of range", start)
+	}
+	end := total
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+	nextToken := ""
+	if end < total {
+		nextToken = strconv.Itoa(end)
+	}
+	return end, nextToken, nil
+}
+
+// csiSnapshot converts snapshot metadata to its CSI representation.
+func csiSnapshot(snap *s3.SnapshotMeta) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     path.Join(snap.BucketName, snap.Prefix()),
+		SourceVolumeId: snap.SourceVolumeID,
+		SizeBytes:      snap.Volume.CapacityBytes,
+		CreationTime:   timestamppb.New(snap.CreationTime),
+		ReadyToUse:     snap.ReadyToUse,
+	}
+}
+
+// snapshotIDToBucketName returns the bucket and snapshot name of a snapshot ID.
+func snapshotIDToBucketName(snapshotID string) (string, string, bool) {
+	splitSnapshotID := strings.SplitN(snapshotID, "/", 2)
+	if len(splitSnapshotID) != 2 {
+		return "", "", false
+	}
+	name, ok := s3.SnapshotName(splitSnapshotID[1])
+	return splitSnapshotID[0], name, ok
+}
+
+// volumeContextFromMeta rebuilds the StorageClass parameters a volume was created with.
+func volumeContextFromMeta(meta *s3.FSMeta) map[string]string {
+	volumeContext := map[string]string{}
+	if meta.Mounter != "" {
+		volumeContext[mounter.TypeKey] = meta.Mounter
+	}
+	if !meta.OwnsBucket {
+		volumeContext[mounter.BucketKey] = meta.BucketName
+	}
+	if meta.UsePrefix {
+		volumeContext[mounter.UsePrefix] = "true"
+		if meta.Prefix != "" {
+			volumeContext[mounter.VolumePrefix] = meta.Prefix
+		}
+	}
+	return volumeContext
+}
+
+// volumeIDFromMeta returns the ID of the volume described by meta.
+func volumeIDFromMeta(meta *s3.FSMeta) string {
+	return path.Join(meta.BucketName, meta.Prefix)
+}
+
+// poolFromParams returns the pool the volumes of a StorageClass are accounted
+// to and its size, which is 0 when the StorageClass has no pool. The name
+// keeps the pools of StorageClasses sharing a bucket apart.
+func poolFromParams(params map[string]string) (string, int64, error) {
+	poolSize, err := parseCapacity(params[mounter.PoolSizeKey])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid %s parameter: %v", mounter.PoolSizeKey, err)
+	}
+	pool := params[mounter.PoolKey]
+	if poolSize > 0 && pool == "" {
+		return "", 0, fmt.Errorf("%s requires the %s parameter naming the pool", mounter.PoolSizeKey, mounter.PoolKey)
+	}
+	return pool, poolSize, nil
+}
+
+// volumeLister lists the volumes stored in S3, as the S3 client does.
+type volumeLister interface {
+	ListFSMeta() ([]*s3.FSMeta, error)
+	ListBucketFSMeta(bucketName string) ([]*s3.FSMeta, error)
+}
+
+// poolLister lists the volumes a pool is loaded from, only those of bucket
+// for a StorageClass with a bucket parameter.
+func poolLister(client volumeLister, bucket string) func() ([]*s3.FSMeta, error) {
+	return func() ([]*s3.FSMeta, error) {
+		if bucket != "" {
+			return client.ListBucketFSMeta(bucket)
+		}
+		return client.ListFSMeta()
+	}
+}
+
 // volumeIDBucketPrefix returns the bucket name and prefix based on the volumeID.
 // Prefix is empty if volumeID does not have a slash in the name.
 func volumeIDToBucketPrefix(volumeID string) (string, string) {
 	// if the volumeID has a slash in it, this volume is stored under a certain prefix within the bucket.
-	splitVolumeID := strings.Split(volumeID, "/")
+	// the prefix itself may contain slashes
+	splitVolumeID := strings.SplitN(volumeID, "/", 2)
 	if len(splitVolumeID) > 1 {
 		return splitVolumeID[0], splitVolumeID[1]
 	}
@@ -16,6 +16,8 @@ var version string
 type driver struct {
 	driver   *csicommon.CSIDriver
 	endpoint string
+	nodeID   string
+	stateDir string
 
 	ids *identifyServer
 	ns  *nodeServer
@@ -27,8 +29,13 @@ var (
 	driverName    = "ictnj.csi.s3-driver"
 )
 
-// New initializes the driver
-func New(nodeID string, endpoint string) (*driver, error) {
+const (
+	// publishNodeKey is set in the publish context to the node the volume was published to
+	publishNodeKey = "ictnj.csi.s3-driver/node"
+)
+
+// New initializes the driver, stateDir holds the records of the volumes mounted on the node
+func New(nodeID string, endpoint string, stateDir string) (*driver, error) {
 	d := csicommon.NewCSIDriver(driverName, vendorVersion, nodeID)
 	if d == nil {
 		glog.Fatalln("Failed to initialize CSI Driver.")
@@ -37,6 +44,8 @@ func New(nodeID string, endpoint string) (*driver, error) {
 	s3Driver := &driver{
 		endpoint: endpoint,
 		driver:   d,
+		nodeID:   nodeID,
+		stateDir: stateDir,
 	}
 	return s3Driver, nil
 }
@@ -51,12 +60,22 @@ func (s3 *driver) newIdentityServer(d *csicommon.CSIDriver) *identifyServer {
 func (s3 *driver) newControllerServer(d *csicommon.CSIDriver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		inFlight:                newInFlight(),
+		pools:                   newPools(),
+		usage:                   newUsageCache(),
 	}
 }
 
 func (s3 *driver) newNodeServer(d *csicommon.CSIDriver) *nodeServer {
+	volumes := newNodeVolumes(s3.stateDir)
+	if err := volumes.load(); err != nil {
+		glog.Errorf("Failed to load volume records from %s: %v", s3.stateDir, err)
+	}
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		nodeID:            s3.nodeID,
+		volumes:           volumes,
+		inFlight:          newInFlight(),
 	}
 }
 
@@ -65,12 +84,33 @@ func (s3 *driver) Run() {
 	glog.Infof("Version: %v ", vendorVersion)
 	// Initialize default library driver
 
-	s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
-	s3.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+	})
+	// the modes of the driver as a whole, s3backer volumes are further restricted to a single node
+	s3.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	})
 
 	// Create GRPC servers
 	s3.ids = s3.newIdentityServer(s3.driver)
 	s3.ns = s3.newNodeServer(s3.driver)
+	go s3.ns.monitorVolumes(volumeMonitorInterval)
 	s3.cs = s3.newControllerServer(s3.driver)
 
 	s := csicommon.NewNonBlockingGRPCServer()
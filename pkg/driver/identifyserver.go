@@ -17,3 +17,27 @@ func (d *identifyServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginIn
 	}
 	return resp, nil
 }
+
+// GetPluginCapabilities advertises the controller service and online volume
+// expansion. A staged s3backer volume reports its expansion as failed until it
+// is staged again, kubelet keeps retrying meanwhile.
+func (d *identifyServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,48 @@
+package driver
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// inFlight tracks the volumes, snapshots and paths an operation is running
+// on, so a retry of the sidecars or the kubelet cannot overlap with it.
+type inFlight struct {
+	mutex sync.Mutex
+	keys  map[string]struct{}
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{keys: map[string]struct{}{}}
+}
+
+// insert marks all keys as busy, or none of them when one already is.
+// It returns false in the latter case.
+func (f *inFlight) insert(keys ...string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, key := range keys {
+		if _, ok := f.keys[key]; ok {
+			return false
+		}
+	}
+	for _, key := range keys {
+		f.keys[key] = struct{}{}
+	}
+	return true
+}
+
+func (f *inFlight) delete(keys ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, key := range keys {
+		delete(f.keys, key)
+	}
+}
+
+// errInFlight is returned for a request overlapping with an operation on the same key.
+func errInFlight(key string) error {
+	return status.Errorf(codes.Aborted, "an operation on %s is already in progress", key)
+}
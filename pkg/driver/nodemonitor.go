@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"CSI-test/mounter"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"k8s.io/mount-utils"
+)
+
+// volumeMonitorInterval is how often the mounts of the volumes on the node are probed.
+const volumeMonitorInterval = 30 * time.Second
+
+// monitorVolumes periodically probes the staged and published paths of every
+// volume on the node and remounts those whose fuse process died.
+func (ns *nodeServer) monitorVolumes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, volumeID := range ns.volumes.ids() {
+			// a running operation changes the mounts anyway, check again next time
+			if !ns.inFlight.insert(volumeID) {
+				continue
+			}
+			ns.checkVolume(volumeID)
+			ns.inFlight.delete(volumeID)
+		}
+	}
+}
+
+// checkVolume remounts the broken mounts of a volume and records the outcome
+// as the condition of the volume.
+func (ns *nodeServer) checkVolume(volumeID string) {
+	stagingPath, _, targets := ns.volumes.mounts(volumeID)
+	broken := ""
+	for _, p := range append([]string{stagingPath}, mapKeys(targets)...) {
+		if isCorruptedMount(p) {
+			broken = p
+			break
+		}
+	}
+	if broken == "" {
+		ns.volumes.setCondition(volumeID, "")
+		return
+	}
+
+	glog.Warningf("Mount %s of volume %s is broken, remounting it", broken, volumeID)
+	meta, cfg, ok := ns.volumes.get(volumeID)
+	if !ok {
+		return
+	}
+	if cfg == nil {
+		// the credentials are only known again on the next stage or publish
+		ns.volumes.setCondition(volumeID, fmt.Sprintf("mount %s is broken", broken))
+		return
+	}
+	m, err := mounter.New(meta, cfg)
+	if err == nil {
+		err = ns.remountVolume(volumeID, m)
+	}
+	if err != nil {
+		glog.Errorf("Failed to remount volume %s: %v", volumeID, err)
+		ns.volumes.setCondition(volumeID, fmt.Sprintf("mount %s is broken, remounting failed: %v", broken, err))
+		return
+	}
+	ns.volumes.setCondition(volumeID, "")
+}
+
+// remountVolume mounts the broken staged mount of a volume again, along with
+// every target it was published to, or only the broken targets when the
+// staged mount is fine.
+func (ns *nodeServer) remountVolume(volumeID string, m mounter.Mounter) error {
+	stagingPath, stageFlags, targets := ns.volumes.mounts(volumeID)
+	stagingBroken := isCorruptedMount(stagingPath)
+	for target := range targets {
+		if !stagingBroken && !isCorruptedMount(target) {
+			delete(targets, target)
+			continue
+		}
+		// the targets hold references to the broken staged mount
+		if err := mount.New("").Unmount(target); err != nil {
+			glog.Warningf("Failed to unmount broken target %s: %v", target, err)
+		}
+	}
+
+	if stagingBroken {
+		// also releases what the mounter set up on top of the fuse mount
+		if err := m.Unstage(stagingPath); err != nil {
+			return err
+		}
+		if err := m.Stage(stagingPath, stageFlags); err != nil {
+			return err
+		}
+		glog.Infof("Volume %s staged again at %s", volumeID, stagingPath)
+	}
+	for target, opts := range targets {
+		if err := m.Mount(stagingPath, target, opts); err != nil {
+			return err
+		}
+		glog.Infof("Volume %s remounted at %s", volumeID, target)
+	}
+	return nil
+}
+
+// volumeCondition returns the condition of a volume recorded by the monitor.
+func (ns *nodeServer) volumeCondition(volumeID string) *csi.VolumeCondition {
+	if message := ns.volumes.condition(volumeID); message != "" {
+		return &csi.VolumeCondition{Abnormal: true, Message: message}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is mounted"}
+}
+
+func isCorruptedMount(p string) bool {
+	if p == "" {
+		return false
+	}
+	_, err := os.Stat(p)
+	return mount.IsCorruptedMnt(err)
+}
+
+func mapKeys(m map[string]mounter.PublishOptions) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
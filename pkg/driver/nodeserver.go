@@ -4,6 +4,7 @@ import (
 	"CSI-test/mounter"
 	"CSI-test/pkg/s3"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
@@ -12,10 +13,16 @@ import (
 	"google.golang.org/grpc/status"
 	"k8s.io/mount-utils"
 	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
 )
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	nodeID   string
+	volumes  *nodeVolumes
+	inFlight *inFlight
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -38,21 +45,24 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	notMnt, err := checkMount(targetPath)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := ns.validatePublishContext(req.GetPublishContext()); err != nil {
+		return nil, err
 	}
-	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+
+	if !ns.inFlight.insert(volumeID, targetPath) {
+		return nil, errInFlight(volumeID)
 	}
+	defer ns.inFlight.delete(volumeID, targetPath)
 
 	deviceID := ""
 	if req.GetPublishContext() != nil {
 		deviceID = req.GetPublishContext()[deviceID]
 	}
 
-	// TODO: Implement readOnly & mountFlags
-	readOnly := req.GetReadonly()
+	// reader only access modes are mounted read-only as well
+	readOnly := req.GetReadonly() || !isWriterAttachment(s3.Attachment{
+		AccessMode: req.GetVolumeCapability().GetAccessMode().GetMode().String(),
+	})
 	// TODO: Check if attrib is correct with context.
 	attrib := req.GetVolumeContext()
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
@@ -67,15 +77,43 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if err != nil {
 		return nil, err
 	}
+	if err := validateVolumeCapability(ns.Driver, meta, req.GetVolumeCapability()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume capability: %v", err)
+	}
 
-	mounter, err := mounter.New(meta, s3.Config)
+	m, err := mounter.New(meta, s3.Config)
 	if err != nil {
 		return nil, err
 	}
-	if err := mounter.Mount(stagingTargetPath, targetPath); err != nil {
+	if err := ns.remountVolume(volumeID, m); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to recover volume %s: %v", volumeID, err)
+	}
+
+	// the device of a raw block volume is bind mounted onto a file
+	if req.GetVolumeCapability().GetBlock() != nil {
+		if err := createBlockTarget(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create target %s: %v", targetPath, err)
+		}
+	}
+	notMnt, err := checkMount(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	opts := mounter.PublishOptions{ReadOnly: readOnly, MountFlags: mountFlags}
+	if err := m.Mount(stagingTargetPath, targetPath, opts); err != nil {
+		if errors.Is(err, mounter.ErrInvalidMountFlag) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 		return nil, err
 	}
 
+	if err := ns.volumes.publish(volumeID, meta, s3.Config, targetPath, opts); err != nil {
+		glog.Errorf("Failed to record target %s of volume %s: %v", targetPath, volumeID, err)
+	}
 	glog.V(4).Infof("S3: volume %s successfully mounted to %s", volumeID, targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -94,9 +132,19 @@ func (ns nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	if err := mounter.FuseUnmount(targetPath); err != nil {
+	if !ns.inFlight.insert(volumeId, targetPath) {
+		return nil, errInFlight(volumeId)
+	}
+	defer ns.inFlight.delete(volumeId, targetPath)
+
+	// only the bind or filesystem mount of this pod goes away, the staged
+	// mount stays until NodeUnstageVolume
+	if err := mount.CleanupMountPoint(targetPath, mount.New(""), true); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if err := ns.volumes.unpublish(volumeId, targetPath); err != nil {
+		glog.Errorf("Failed to remove target %s from the record of volume %s: %v", targetPath, volumeId, err)
+	}
 	glog.V(4).Infof("s3: volume %s has been unmounted.", volumeId)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -118,14 +166,15 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
-
-	notMnt, err := checkMount(stagingTargetPath)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := ns.validatePublishContext(req.GetPublishContext()); err != nil {
+		return nil, err
 	}
-	if !notMnt {
-		return &csi.NodeStageVolumeResponse{}, nil
+
+	if !ns.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
 	}
+	defer ns.inFlight.delete(volumeID)
+
 	client, err := s3.NewClientFromSecret(req.GetSecrets())
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
@@ -134,12 +183,47 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if err != nil {
 		return nil, err
 	}
-	mounter, err := mounter.New(meta, client.Config)
+	if err := validateVolumeCapability(ns.Driver, meta, req.GetVolumeCapability()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume capability: %v", err)
+	}
+	m, err := mounter.New(meta, client.Config)
 	if err != nil {
 		return nil, err
 	}
-	if err := mounter.Stage(stagingTargetPath); err != nil {
-		return nil, err
+	if err := ns.remountVolume(volumeID, m); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to recover volume %s: %v", volumeID, err)
+	}
+
+	notMnt, err := checkMount(stagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	stageFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+	if notMnt {
+		if err := m.Stage(stagingTargetPath, stageFlags); err != nil {
+			if errors.Is(err, mounter.ErrInvalidMountFlag) {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			return nil, err
+		}
+	}
+	// also done for a retry, recording the flags may have failed after staging
+	if mounter.IsBlockMounter(meta.Mounter) {
+		// not the stored capacity, the controller may expand the volume meanwhile
+		block, deviceBytes := meta.Block, meta.CapacityBytes
+		meta, err = client.UpdateFSMeta(bucketName, prefix, func(meta *s3.FSMeta) bool {
+			changed := !meta.Staged || (!block && !meta.Initialized) || meta.DeviceBytes != deviceBytes
+			meta.Staged = true
+			meta.Initialized = meta.Initialized || !block
+			meta.DeviceBytes = deviceBytes
+			return changed
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record that volume %s is staged: %v", volumeID, err)
+		}
+	}
+	if err := ns.volumes.stage(volumeID, meta, client.Config, stagingTargetPath, stageFlags); err != nil {
+		glog.Errorf("Failed to record staging path of volume %s: %v", volumeID, err)
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
@@ -158,30 +242,302 @@ func (ns nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if !ns.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
+	}
+	defer ns.inFlight.delete(volumeID)
+
+	// every pod of the node shares the staged mount, keep it while any of them still uses it
+	for _, p := range mounter.StagedPaths(stagingTargetPath) {
+		if notMnt, err := mount.New("").IsLikelyNotMountPoint(p); err == nil && !notMnt {
+			refs, err := mount.New("").GetMountRefs(p)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if len(refs) > 0 {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still published at %v", volumeID, refs)
+			}
+		}
+	}
+
+	// the request carries no volume metadata, the mounter is found from the staged mount
+	mounterType, err := mounter.MountedType(stagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounterType != "" {
+		// the recorded metadata names the files kept besides the mount, such as the block cache
+		meta := &s3.FSMeta{Mounter: mounterType}
+		if recorded, _, ok := ns.volumes.get(volumeID); ok && recorded != nil {
+			copied := *recorded
+			copied.Mounter = mounterType
+			meta = &copied
+		}
+		m, err := mounter.New(meta, &s3.Config{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// waits for the fuse process to exit
+		if err := m.Unstage(stagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unstage volume %s: %v", volumeID, err)
+		}
+		ns.markUnstaged(volumeID)
+	}
+
+	// removes the staging directory, an already unstaged path is not an error
+	if err := mount.CleanupMountPoint(stagingTargetPath, mount.New(""), true); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to clean up staging path %s: %v", stagingTargetPath, err)
+	}
+	// the fuse process may have died before its credentials could be removed
+	if err := mounter.RemoveCredentials(stagingTargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove credentials of %s: %v", stagingTargetPath, err)
+	}
+
+	if err := ns.volumes.unstage(volumeID); err != nil {
+		glog.Errorf("Failed to remove the record of volume %s: %v", volumeID, err)
+	}
+	glog.V(4).Infof("s3: volume %s has been unstaged.", volumeID)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// markUnstaged records that the block device image of a volume was unstaged
+// cleanly, which saves checking its filesystem on the next stage. It needs
+// the credentials of the volume, when they are unknown the image is simply
+// checked once more.
+func (ns nodeServer) markUnstaged(volumeID string) {
+	meta, cfg, ok := ns.volumes.get(volumeID)
+	if !ok || cfg == nil || !mounter.IsBlockMounter(meta.Mounter) {
+		return
+	}
+	client, err := s3.NewClient(cfg)
+	if err == nil {
+		_, err = client.UpdateFSMeta(meta.BucketName, meta.Prefix, func(meta *s3.FSMeta) bool {
+			changed := meta.Staged
+			meta.Staged = false
+			return changed
+		})
+	}
+	if err != nil {
+		glog.Warningf("Failed to record that volume %s was unstaged: %v", volumeID, err)
+	}
+}
+
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	// currently there is a single NodeServer capability according to the spec
-	nscap := &csi.NodeServiceCapability{
-		Type: &csi.NodeServiceCapability_Rpc{
-			Rpc: &csi.NodeServiceCapability_RPC{
-				Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	var caps []*csi.NodeServiceCapability
+	for _, c := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	} {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: c,
+				},
 			},
-		},
+		})
 	}
 
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			nscap,
-		},
+		Capabilities: caps,
 	}, nil
 
 }
 
 func (ns nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return &csi.NodeExpandVolumeResponse{}, status.Error(codes.Unimplemented, "NodeExpandVolume is not implemented")
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	stagingTargetPath := req.GetStagingTargetPath()
+	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging Target path missing in request")
+	}
+
+	if !ns.inFlight.insert(volumeID) {
+		return nil, errInFlight(volumeID)
+	}
+	defer ns.inFlight.delete(volumeID)
+
+	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize S3 client: %s", err)
+	}
+	meta, err := client.GetFSMeta(bucketName, prefix)
+	if err != nil {
+		if s3.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get metadata of volume %s: %v", volumeID, err)
+	}
+	// the controller has already recorded the new size, but never shrink
+	if capacityBytes > meta.CapacityBytes {
+		meta.CapacityBytes = capacityBytes
+	}
+
+	mounter, err := mounter.New(meta, client.Config)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := mounter.Expand(stagingTargetPath, volumePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to expand volume %s: %v", volumeID, err)
+	}
+
+	glog.V(4).Infof("s3: volume %s expanded to %d bytes", volumeID, meta.CapacityBytes)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: meta.CapacityBytes}, nil
+}
+
+func (ns nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	fi, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+		}
+		if mount.IsCorruptedMnt(err) {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: true,
+					Message:  fmt.Sprintf("mount %s is broken: %v", volumePath, err),
+				},
+			}, nil
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// raw block volumes only have a size
+	if fi.Mode()&os.ModeDevice != 0 {
+		size, err := blockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get size of %s: %v", volumePath, err)
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:  csi.VolumeUsage_BYTES,
+					Total: size,
+				},
+			},
+			VolumeCondition: ns.volumeCondition(volumeID),
+		}, nil
+	}
+
+	// the s3backer filesystem knows its real usage, the object based
+	// mounters only report made up numbers and are measured from S3 instead,
+	// unless the credentials are unknown since the driver restarted
+	meta, cfg, ok := ns.volumes.get(volumeID)
+	if !ok || cfg == nil || mounter.IsBlockMounter(meta.Mounter) {
+		resp, err := statfsVolumeStats(volumePath)
+		if err != nil {
+			return nil, err
+		}
+		resp.VolumeCondition = ns.volumeCondition(volumeID)
+		return resp, nil
+	}
+
+	usedBytes, usedObjects, err := ns.volumes.usage(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get usage of volume %s: %v", volumeID, err)
+	}
+	available := meta.CapacityBytes - usedBytes
+	if available < 0 {
+		available = 0
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     meta.CapacityBytes,
+				Used:      usedBytes,
+				Available: available,
+			},
+			{
+				Unit: csi.VolumeUsage_INODES,
+				Used: usedObjects,
+			},
+		},
+		VolumeCondition: ns.volumeCondition(volumeID),
+	}, nil
+}
+
+func statfsVolumeStats(volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &statfs); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to statfs %s: %v", volumePath, err)
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(statfs.Blocks) * statfs.Bsize,
+				Used:      int64(statfs.Blocks-statfs.Bfree) * statfs.Bsize,
+				Available: int64(statfs.Bavail) * statfs.Bsize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(statfs.Files),
+				Used:      int64(statfs.Files - statfs.Ffree),
+				Available: int64(statfs.Ffree),
+			},
+		},
+	}, nil
+}
+
+// blkGetSize64 is the BLKGETSIZE64 ioctl returning the size of a block device in bytes.
+const blkGetSize64 = 0x80081272
+
+func blockDeviceSize(devicePath string) (int64, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
+
+// createBlockTarget creates the file the device of a raw block volume is bind mounted onto.
+func createBlockTarget(targetPath string) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(targetPath, os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// validatePublishContext ensures a volume attached by ControllerPublishVolume
+// is only used on the node it was attached to.
+func (ns *nodeServer) validatePublishContext(publishContext map[string]string) error {
+	if node, ok := publishContext[publishNodeKey]; ok && node != ns.nodeID {
+		return status.Errorf(codes.FailedPrecondition, "volume is published to node %s, not to %s", node, ns.nodeID)
+	}
+	return nil
 }
 
 func checkMount(targetPath string) (bool, error) {
@@ -195,6 +551,13 @@ func checkMount(targetPath string) (bool, error) {
 				return false, err
 			}
 			notMnt = true
+		} else if mount.IsCorruptedMnt(err) {
+			// a dead fuse mount is still in the mount table, replace it
+			glog.Warningf("Mount %s is broken, unmounting it: %v", targetPath, err)
+			if err := mount.New("").Unmount(targetPath); err != nil {
+				return false, err
+			}
+			notMnt = true
 		} else {
 			return false, err
 		}
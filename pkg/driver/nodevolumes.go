@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"CSI-test/mounter"
+	"CSI-test/pkg/s3"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// volumeUsageTTL is how long the object usage of a volume is cached,
+	// kubelet polls the volume stats far more often than that.
+	volumeUsageTTL = 5 * time.Minute
+	recordSuffix   = ".json"
+)
+
+var errVolumeNotTracked = errors.New("volume is not staged or published on this node")
+
+// nodeVolumes keeps the metadata and credentials of the volumes staged or
+// published on this node, for the calls that carry neither. The records are
+// persisted without credentials in stateDir, so the mounts of the volumes can
+// be recovered after a restart of the driver.
+type nodeVolumes struct {
+	mutex    sync.Mutex
+	stateDir string
+	volumes  map[string]*nodeVolume
+}
+
+type nodeVolume struct {
+	VolumeID    string                            `json:"VolumeID"`
+	Meta        *s3.FSMeta                        `json:"Meta"`
+	StagingPath string                            `json:"StagingPath"`
+	StageFlags  []string                          `json:"StageFlags"`
+	Targets     map[string]mounter.PublishOptions `json:"Targets"`
+
+	// cfg is only known once a call with secrets was made since the driver started
+	cfg *s3.Config
+	// condition describes why the mounts of the volume are unhealthy, it is empty when they are fine
+	condition string
+
+	usageBytes   int64
+	usageObjects int64
+	usageTime    time.Time
+}
+
+func newNodeVolumes(stateDir string) *nodeVolumes {
+	return &nodeVolumes{stateDir: stateDir, volumes: map[string]*nodeVolume{}}
+}
+
+// load reads the records persisted by a previous run of the driver and
+// reports the staged and published paths whose fuse mount died with it.
+func (nv *nodeVolumes) load() error {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+
+	if err := os.MkdirAll(nv.stateDir, 0700); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(nv.stateDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), recordSuffix) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(nv.stateDir, file.Name()))
+		if err != nil {
+			return err
+		}
+		v := &nodeVolume{}
+		if err := json.Unmarshal(b, v); err != nil {
+			glog.Errorf("Ignoring invalid volume record %s: %v", file.Name(), err)
+			continue
+		}
+		if v.Targets == nil {
+			v.Targets = map[string]mounter.PublishOptions{}
+		}
+		nv.volumes[v.VolumeID] = v
+
+		for _, p := range v.paths() {
+			if _, err := os.Stat(p); mount.IsCorruptedMnt(err) {
+				glog.Warningf("Mount %s of volume %s is broken, it is recovered on the next stage or publish", p, v.VolumeID)
+				v.condition = fmt.Sprintf("mount %s is broken", p)
+			}
+		}
+	}
+	glog.Infof("Loaded %d volume records from %s", len(nv.volumes), nv.stateDir)
+	return nil
+}
+
+// stage records the staging path of a volume, along with the credentials it was staged with.
+func (nv *nodeVolumes) stage(volumeID string, meta *s3.FSMeta, cfg *s3.Config, stagingPath string, stageFlags []string) error {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	v := nv.getOrCreate(volumeID)
+	v.Meta, v.cfg = meta, cfg
+	v.StagingPath, v.StageFlags = stagingPath, stageFlags
+	return nv.persist(v)
+}
+
+// publish records a target path a volume is mounted at.
+func (nv *nodeVolumes) publish(volumeID string, meta *s3.FSMeta, cfg *s3.Config, target string, opts mounter.PublishOptions) error {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	v := nv.getOrCreate(volumeID)
+	v.Meta, v.cfg = meta, cfg
+	v.Targets[target] = opts
+	return nv.persist(v)
+}
+
+func (nv *nodeVolumes) unpublish(volumeID string, target string) error {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	v, ok := nv.volumes[volumeID]
+	if !ok {
+		return nil
+	}
+	delete(v.Targets, target)
+	return nv.persist(v)
+}
+
+func (nv *nodeVolumes) unstage(volumeID string) error {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	delete(nv.volumes, volumeID)
+	err := os.Remove(nv.recordPath(volumeID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// get returns the metadata and credentials of a volume. The credentials are
+// nil when the volume was not used since the driver started.
+func (nv *nodeVolumes) get(volumeID string) (*s3.FSMeta, *s3.Config, bool) {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	v, ok := nv.volumes[volumeID]
+	if !ok {
+		return nil, nil, false
+	}
+	return v.Meta, v.cfg, true
+}
+
+// mounts returns the staging path and flags of a volume and the targets it is published to.
+func (nv *nodeVolumes) mounts(volumeID string) (string, []string, map[string]mounter.PublishOptions) {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	v, ok := nv.volumes[volumeID]
+	if !ok {
+		return "", nil, nil
+	}
+	targets := map[string]mounter.PublishOptions{}
+	for target, opts := range v.Targets {
+		targets[target] = opts
+	}
+	return v.StagingPath, v.StageFlags, targets
+}
+
+// ids returns the IDs of the volumes staged or published on this node.
+func (nv *nodeVolumes) ids() []string {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	ids := make([]string, 0, len(nv.volumes))
+	for volumeID := range nv.volumes {
+		ids = append(ids, volumeID)
+	}
+	return ids
+}
+
+// setCondition records why the mounts of a volume are unhealthy, an empty
+// message marks them healthy again.
+func (nv *nodeVolumes) setCondition(volumeID string, message string) {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	if v, ok := nv.volumes[volumeID]; ok {
+		v.condition = message
+	}
+}
+
+// condition returns the message set by setCondition.
+func (nv *nodeVolumes) condition(volumeID string) string {
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	if v, ok := nv.volumes[volumeID]; ok {
+		return v.condition
+	}
+	return ""
+}
+
+// usage returns the size and number of the objects of a volume, listing them
+// from S3 at most once per volumeUsageTTL.
+func (nv *nodeVolumes) usage(volumeID string) (int64, int64, error) {
+	nv.mutex.Lock()
+	v, ok := nv.volumes[volumeID]
+	if !ok || v.cfg == nil {
+		nv.mutex.Unlock()
+		return 0, 0, errVolumeNotTracked
+	}
+	if time.Since(v.usageTime) < volumeUsageTTL {
+		defer nv.mutex.Unlock()
+		return v.usageBytes, v.usageObjects, nil
+	}
+	meta, cfg := v.Meta, v.cfg
+	nv.mutex.Unlock()
+
+	client, err := s3.NewClient(cfg)
+	if err != nil {
+		return 0, 0, err
+	}
+	bytes, objects, err := client.PrefixUsage(meta.BucketName, path.Join(meta.Prefix, meta.FSPath))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	nv.mutex.Lock()
+	defer nv.mutex.Unlock()
+	v.usageBytes, v.usageObjects, v.usageTime = bytes, objects, time.Now()
+	return bytes, objects, nil
+}
+
+func (nv *nodeVolumes) getOrCreate(volumeID string) *nodeVolume {
+	v, ok := nv.volumes[volumeID]
+	if !ok {
+		v = &nodeVolume{VolumeID: volumeID, Targets: map[string]mounter.PublishOptions{}}
+		nv.volumes[volumeID] = v
+	}
+	return v
+}
+
+// persist writes the record of a volume, replacing the previous one atomically.
+func (nv *nodeVolumes) persist(v *nodeVolume) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(nv.stateDir, 0700); err != nil {
+		return err
+	}
+	tmp := nv.recordPath(v.VolumeID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, nv.recordPath(v.VolumeID))
+}
+
+func (nv *nodeVolumes) recordPath(volumeID string) string {
+	return filepath.Join(nv.stateDir, url.PathEscape(volumeID)+recordSuffix)
+}
+
+func (v *nodeVolume) paths() []string {
+	var paths []string
+	if v.StagingPath != "" {
+		paths = append(paths, v.StagingPath)
+	}
+	for target := range v.Targets {
+		paths = append(paths, target)
+	}
+	return paths
+}
@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"CSI-test/pkg/s3"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pools keeps the capacity of the volumes of every pool, so CreateVolume
+// neither lists all volumes nor races another CreateVolume of the same pool.
+// The volumes of a pool are loaded from their metadata on first use, after
+// that the controller, which is the only one creating and deleting volumes,
+// keeps them up to date.
+type pools struct {
+	mutex sync.Mutex
+	// volumes holds the capacity of every volume by pool and volume ID
+	volumes map[string]map[string]int64
+}
+
+func newPools() *pools {
+	return &pools{volumes: map[string]map[string]int64{}}
+}
+
+// reserve adds a volume to a pool, unless its capacity does not fit in
+// poolSize anymore. A volume already in the pool is only resized, which makes
+// retries of CreateVolume idempotent and is how an expansion is reserved. list returns the volumes the pool is
+// loaded from the first time. The returned function undoes the reservation
+// when the volume could not be created after all.
+func (p *pools) reserve(pool, volumeID string, capacityBytes, poolSize int64, list func() ([]*s3.FSMeta, error)) (func(), error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	volumes, err := p.load(pool, list)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to compute used capacity: %v", err)
+	}
+	used := int64(0)
+	for id, c := range volumes {
+		if id != volumeID {
+			used += c
+		}
+	}
+	if used+capacityBytes > poolSize {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"requested capacity %d exceeds the %d bytes left in pool %s", capacityBytes, poolSize-used, pool)
+	}
+	previous, existed := volumes[volumeID]
+	volumes[volumeID] = capacityBytes
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if existed {
+			volumes[volumeID] = previous
+		} else {
+			delete(volumes, volumeID)
+		}
+	}, nil
+}
+
+// release removes a volume from whichever pool it is in.
+func (p *pools) release(volumeID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, volumes := range p.volumes {
+		delete(volumes, volumeID)
+	}
+}
+
+// used returns the capacity of all volumes of a pool.
+func (p *pools) used(pool string, list func() ([]*s3.FSMeta, error)) (int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	volumes, err := p.load(pool, list)
+	if err != nil {
+		return 0, err
+	}
+	used := int64(0)
+	for _, c := range volumes {
+		used += c
+	}
+	return used, nil
+}
+
+func (p *pools) load(pool string, list func() ([]*s3.FSMeta, error)) (map[string]int64, error) {
+	if volumes, ok := p.volumes[pool]; ok {
+		return volumes, nil
+	}
+	metas, err := list()
+	if err != nil && !s3.IsNotExist(err) {
+		return nil, err
+	}
+	volumes := map[string]int64{}
+	for _, meta := range metas {
+		if meta.Pool == pool {
+			volumes[volumeIDFromMeta(meta)] = meta.CapacityBytes
+		}
+	}
+	p.volumes[pool] = volumes
+	return volumes, nil
+}
@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"sync"
+	"time"
+)
+
+// usageCache keeps the object usage of the volumes probed by
+// ControllerGetVolume, which is called far more often than listing all
+// objects of a volume is worth.
+type usageCache struct {
+	mutex   sync.Mutex
+	volumes map[string]cachedUsage
+}
+
+type cachedUsage struct {
+	bytes int64
+	time  time.Time
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{volumes: map[string]cachedUsage{}}
+}
+
+// get returns the bytes used by a volume, calling list at most once per
+// volumeUsageTTL. Failures are not cached.
+func (u *usageCache) get(volumeID string, list func() (int64, error)) (int64, error) {
+	u.mutex.Lock()
+	c, ok := u.volumes[volumeID]
+	u.mutex.Unlock()
+	if ok && time.Since(c.time) < volumeUsageTTL {
+		return c.bytes, nil
+	}
+
+	bytes, err := list()
+	if err != nil {
+		return 0, err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.volumes[volumeID] = cachedUsage{bytes: bytes, time: time.Now()}
+	return bytes, nil
+}
+
+// forget drops the usage of a deleted volume.
+func (u *usageCache) forget(volumeID string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.volumes, volumeID)
+}
@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	attachmentsName = ".attachments.json"
+)
+
+// Attachments records the nodes a volume is published to by ControllerPublishVolume.
+type Attachments struct {
+	Nodes map[string]Attachment `json:"Nodes"`
+}
+
+type Attachment struct {
+	AccessMode string    `json:"AccessMode"`
+	ReadOnly   bool      `json:"ReadOnly"`
+	Time       time.Time `json:"Time"`
+}
+
+// GetAttachments returns the attachments of the volume stored under prefix
+// and the ETag to pass to SetAttachments. A volume without attachments
+// returns an empty list and an empty ETag.
+func (client *s3Client) GetAttachments(bucketName, prefix string) (*Attachments, string, error) {
+	attachments := &Attachments{Nodes: map[string]Attachment{}}
+	obj, err := client.minio.GetObject(client.ctx, bucketName, path.Join(prefix, attachmentsName), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer obj.Close()
+	objInfo, err := obj.Stat()
+	if err != nil {
+		if IsNotExist(err) {
+			return attachments, "", nil
+		}
+		return nil, "", err
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(b, attachments); err != nil {
+		return nil, "", err
+	}
+	if attachments.Nodes == nil {
+		attachments.Nodes = map[string]Attachment{}
+	}
+	return attachments, objInfo.ETag, nil
+}
+
+// SetAttachments replaces the attachments of the volume stored under prefix,
+// provided they were not changed since they were read with the given ETag.
+// A concurrent change is reported as an error for which IsConflict is true.
+// Removing the last attachment removes the object.
+func (client *s3Client) SetAttachments(bucketName, prefix string, attachments *Attachments, etag string) error {
+	objectName := path.Join(prefix, attachmentsName)
+
+	if len(attachments.Nodes) == 0 {
+		if etag == "" {
+			return nil
+		}
+		// S3 has no conditional delete, check for changes right before removing
+		objInfo, err := client.minio.StatObject(client.ctx, bucketName, objectName, minio.StatObjectOptions{})
+		if err != nil {
+			if IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if objInfo.ETag != etag {
+			return errConflict
+		}
+		return client.minio.RemoveObject(client.ctx, bucketName, objectName, minio.RemoveObjectOptions{})
+	}
+
+	return client.putJSONIfMatch(bucketName, objectName, attachments, etag)
+}
@@ -4,15 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
 	"io"
 	"net/url"
+	"os"
 	"path"
+	"sort"
+	"strings"
 )
 
 const (
 	metadataName = ".metadata.json"
+	// maxCopyObjectSize is the largest object a single CopyObject can copy
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
 )
 
 type s3Client struct {
@@ -28,6 +36,8 @@ type Config struct {
 	Region          string
 	Endpoint        string
 	Mounter         string
+	// EncryptionKey encrypts the data of s3backer volumes created with encryption
+	EncryptionKey string
 }
 
 type FSMeta struct {
@@ -37,6 +47,58 @@ type FSMeta struct {
 	Mounter       string `json:"Mounter"`
 	FSPath        string `json:"FSPath"`
 	CapacityBytes int64  `json:"CapacityBytes"`
+	// OwnsBucket is set when the bucket was created for this volume alone
+	// and may be removed together with it.
+	OwnsBucket bool `json:"OwnsBucket"`
+	// Pool is the pool the capacity of the volume is accounted to, empty for
+	// volumes of a StorageClass without a pool size.
+	Pool string `json:"Pool,omitempty"`
+	// PoolSize is the size of the pool at creation, an expansion of the
+	// volume has to fit into it as well.
+	PoolSize int64 `json:"PoolSize,omitempty"`
+	// AccessModes are the names of the CSI access modes granted at creation.
+	AccessModes []string `json:"AccessModes,omitempty"`
+	// Initialized is set once the block device image of the volume holds a
+	// filesystem, it must never be formatted again afterwards.
+	Initialized bool `json:"Initialized,omitempty"`
+	// FsType is the filesystem of the block device image, empty for the default.
+	FsType string `json:"FsType,omitempty"`
+	// Block is set for raw block volumes, their block device image is never formatted.
+	Block bool `json:"Block,omitempty"`
+	// DeviceBytes is the size the block device image was last staged with. A
+	// larger CapacityBytes is an expansion the next stage still has to apply.
+	DeviceBytes int64 `json:"DeviceBytes,omitempty"`
+	// Staged is set while the block device image is staged on a node. Finding
+	// it set when staging means the image was not unstaged cleanly and its
+	// filesystem has to be checked.
+	Staged bool `json:"Staged,omitempty"`
+	// S3backer holds the tuning of s3backer volumes, it is nil for older volumes.
+	S3backer *S3backerOptions `json:"S3backer,omitempty"`
+}
+
+// S3backerOptions are the s3backer settings of a volume. BlockSize, Compress
+// and Encrypt define how the data is stored and are fixed at creation, the
+// cache settings only apply to the nodes staging the volume.
+type S3backerOptions struct {
+	BlockSize         int64  `json:"BlockSize,omitempty"`
+	BlockCacheSize    int    `json:"BlockCacheSize,omitempty"`
+	BlockCacheThreads int    `json:"BlockCacheThreads,omitempty"`
+	BlockCacheDir     string `json:"BlockCacheDir,omitempty"`
+	Compress          bool   `json:"Compress,omitempty"`
+	Encrypt           bool   `json:"Encrypt,omitempty"`
+	MD5CacheSize      int    `json:"MD5CacheSize,omitempty"`
+	// MD5CacheTime is in milliseconds
+	MD5CacheTime int `json:"MD5CacheTime,omitempty"`
+}
+
+// HasAccessMode reports whether the access mode was granted to the volume.
+func (meta *FSMeta) HasAccessMode(mode string) bool {
+	for _, m := range meta.AccessModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
 }
 
 func NewClient(cfg *Config) (*s3Client, error) {
@@ -70,15 +132,60 @@ func NewClientFromSecret(secret map[string]string) (*s3Client, error) {
 		SecretAccessKey: secret["secretAccessKey"],
 		Region:          secret["region"],
 		Endpoint:        secret["endpoint"],
+		EncryptionKey:   secret["encryptionKey"],
 		// Mounter is set in the volume preferences, not secrets
 		Mounter: "",
 	})
 }
 
+// NewClientFromEnv creates a client from the secret keys exposed as environment
+// variables. It is used by the controller calls which carry no secrets.
+func NewClientFromEnv() (*s3Client, error) {
+	secret := map[string]string{}
+	for _, key := range []string{"accessKeyID", "secretAccessKey", "region", "endpoint"} {
+		secret[key] = os.Getenv(key)
+	}
+	if secret["endpoint"] == "" {
+		return nil, errors.New("S3 endpoint is not set in the environment")
+	}
+	return NewClientFromSecret(secret)
+}
+
+// NewClientFromSecretOrEnv falls back to NewClientFromEnv when secret is empty.
+func NewClientFromSecretOrEnv(secret map[string]string) (*s3Client, error) {
+	if len(secret) > 0 {
+		return NewClientFromSecret(secret)
+	}
+	return NewClientFromEnv()
+}
+
 func (client *s3Client) BucketExists(bucketName string) (bool, error) {
 	return client.minio.BucketExists(client.ctx, bucketName)
 }
 
+// PrefixUsage returns the total size and number of the objects stored under prefix.
+func (client *s3Client) PrefixUsage(bucketName string, prefix string) (int64, int64, error) {
+	var size, count int64
+	err := client.listObjects(bucketName, prefix, func(obj minio.ObjectInfo) {
+		size += obj.Size
+		count++
+	})
+	return size, count, err
+}
+
+// ListBuckets returns the names of all buckets visible to the client.
+func (client *s3Client) ListBuckets() ([]string, error) {
+	buckets, err := client.minio.ListBuckets(client.ctx)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	return names, nil
+}
+
 func (client *s3Client) CreateBucket(bucketName string) error {
 	return client.minio.MakeBucket(client.ctx, bucketName, minio.MakeBucketOptions{Region: client.Config.Region})
 }
@@ -93,34 +200,389 @@ func (client *s3Client) CreatePrefix(bucketName string, prefix string) error {
 }
 
 func (client *s3Client) SetFSMeta(meta *FSMeta) error {
+	return client.putJSON(meta.BucketName, path.Join(meta.Prefix, metadataName), meta)
+}
+
+// fsMetaUpdateRetries bounds how often UpdateFSMeta retries after a concurrent change.
+const fsMetaUpdateRetries = 5
+
+// UpdateFSMeta applies update to the metadata of a volume and writes it back,
+// provided nobody changed it in between. Otherwise it is read and updated
+// again. update returns false when the metadata needs no change, in which
+// case nothing is written. The metadata as stored is returned.
+func (client *s3Client) UpdateFSMeta(bucketName, prefix string, update func(meta *FSMeta) bool) (*FSMeta, error) {
+	objectName := path.Join(prefix, metadataName)
+	for i := 0; i < fsMetaUpdateRetries; i++ {
+		var meta FSMeta
+		etag, err := client.getJSONWithETag(bucketName, objectName, &meta)
+		if err != nil {
+			return nil, err
+		}
+		if !update(&meta) {
+			return &meta, nil
+		}
+		err = client.putJSONIfMatch(bucketName, objectName, &meta, etag)
+		if err == nil {
+			return &meta, nil
+		}
+		if !IsConflict(err) {
+			return nil, err
+		}
+	}
+	return nil, errConflict
+}
+
+// GetFSMeta get metadata of bucket
+func (client *s3Client) GetFSMeta(bucketName, prefix string) (*FSMeta, error) {
+	var meta FSMeta
+	if err := client.getJSON(bucketName, path.Join(prefix, metadataName), &meta); err != nil {
+		return &FSMeta{}, err
+	}
+	return &meta, nil
+}
+
+func (client *s3Client) putJSON(bucketName, objectName string, v interface{}) error {
 	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(meta)
+	if err := json.NewEncoder(b).Encode(v); err != nil {
+		return err
+	}
 	opts := minio.PutObjectOptions{ContentType: "application/json"}
-	_, err := client.minio.PutObject(
-		client.ctx, meta.BucketName, path.Join(meta.Prefix, metadataName), b, int64(b.Len()), opts)
+	_, err := client.minio.PutObject(client.ctx, bucketName, objectName, b, int64(b.Len()), opts)
 	return err
+}
 
+// putJSONIfMatch writes v to objectName provided the object still has the
+// given ETag, or does not exist yet for an empty ETag. A concurrent change is
+// reported as an error for which IsConflict is true.
+func (client *s3Client) putJSONIfMatch(bucketName, objectName string, v interface{}, etag string) error {
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(v); err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{ContentType: "application/json"}
+	if etag != "" {
+		opts.SetMatchETag(etag)
+	} else {
+		// If-None-Match makes creating the object atomic
+		opts.SetMatchETagExcept("*")
+	}
+	_, err := client.minio.PutObject(client.ctx, bucketName, objectName, b, int64(b.Len()), opts)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return errConflict
+		}
+		return err
+	}
+	return nil
 }
 
-// GetFSMeta get metadata of bucket
-func (client *s3Client) GetFSMeta(bucketName, prefix string) (*FSMeta, error) {
-	// what does this mean?
-	opts := minio.GetObjectOptions{}
-	obj, err := client.minio.GetObject(client.ctx, bucketName, path.Join(prefix, metadataName), opts)
+func (client *s3Client) getJSON(bucketName, objectName string, v interface{}) error {
+	_, err := client.getJSONWithETag(bucketName, objectName, v)
+	return err
+}
+
+// getJSONWithETag reads objectName into v and returns the ETag to pass to putJSONIfMatch.
+func (client *s3Client) getJSONWithETag(bucketName, objectName string, v interface{}) (string, error) {
+	obj, err := client.minio.GetObject(client.ctx, bucketName, objectName, minio.GetObjectOptions{})
 	if err != nil {
-		return &FSMeta{}, err
+		return "", err
 	}
+	defer obj.Close()
 	objInfo, err := obj.Stat()
 	if err != nil {
-		return &FSMeta{}, err
+		return "", err
 	}
-	b := make([]byte, objInfo.Size)
-	_, err = obj.Read(b)
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		return "", err
+	}
+	return objInfo.ETag, json.Unmarshal(b, v)
+}
 
-	if err != nil && err != io.EOF {
-		return &FSMeta{}, err
+// RemoveFSMeta removes the metadata object of the volume stored under prefix.
+func (client *s3Client) RemoveFSMeta(bucketName, prefix string) error {
+	err := client.minio.RemoveObject(client.ctx, bucketName, path.Join(prefix, metadataName), minio.RemoveObjectOptions{})
+	if err != nil && !IsNotExist(err) {
+		return err
 	}
-	var meta FSMeta
-	err = json.Unmarshal(b, &meta)
-	return &meta, err
+	return nil
+}
+
+// RemovePrefix removes every object stored under prefix, except the volume
+// metadata which is left for RemoveFSMeta. Objects are deleted in batches.
+func (client *s3Client) RemovePrefix(bucketName string, prefix string) error {
+	metaObject := path.Join(prefix, metadataName)
+
+	var listErr error
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		listErr = client.listObjects(bucketName, prefix, func(obj minio.ObjectInfo) {
+			if obj.Key != metaObject {
+				objectsCh <- obj
+			}
+		})
+	}()
+
+	var removeErr error
+	for e := range client.minio.RemoveObjects(client.ctx, bucketName, objectsCh, minio.RemoveObjectsOptions{}) {
+		if removeErr == nil {
+			removeErr = fmt.Errorf("failed to remove object %s: %w", e.ObjectName, e.Err)
+		}
+	}
+	if listErr != nil {
+		return listErr
+	}
+	return removeErr
+}
+
+// CopyPrefix server side copies every object stored under srcPrefix to the
+// same relative key under dstPrefix. Objects already copied with the same
+// ETag are skipped, so a retry resumes an interrupted copy.
+func (client *s3Client) CopyPrefix(srcBucket, srcPrefix, dstBucket, dstPrefix string) error {
+	listPrefix := ""
+	if srcPrefix != "" {
+		listPrefix = srcPrefix + "/"
+	}
+	// a retry only copies what is missing or differs from the source
+	copied := map[string]minio.ObjectInfo{}
+	err := client.listObjects(dstBucket, dstPrefix, func(obj minio.ObjectInfo) {
+		copied[obj.Key] = obj
+	})
+	if err != nil {
+		return err
+	}
+
+	var copyErr error
+	err = client.listObjects(srcBucket, srcPrefix, func(obj minio.ObjectInfo) {
+		rel := strings.TrimPrefix(obj.Key, listPrefix)
+		if copyErr != nil || rel == "" || rel == metadataName || rel == attachmentsName {
+			return
+		}
+		// keep the trailing slash of directory objects
+		dstObject := rel
+		if dstPrefix != "" {
+			dstObject = dstPrefix + "/" + rel
+		}
+		if c, ok := copied[dstObject]; ok && c.ETag == obj.ETag && c.Size == obj.Size {
+			return
+		}
+		src := minio.CopySrcOptions{Bucket: srcBucket, Object: obj.Key}
+		dst := minio.CopyDestOptions{Bucket: dstBucket, Object: dstObject}
+		// CopyObject is limited to 5GiB, ComposeObject copies larger objects in parts
+		if obj.Size > maxCopyObjectSize {
+			_, copyErr = client.minio.ComposeObject(client.ctx, dst, src)
+		} else {
+			_, copyErr = client.minio.CopyObject(client.ctx, dst, src)
+		}
+		if copyErr != nil {
+			copyErr = fmt.Errorf("failed to copy object %s: %w", obj.Key, copyErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return copyErr
+}
+
+// listObjects calls fn for every object stored under prefix. Listing the root
+// of a bucket leaves out the snapshots stored in it.
+func (client *s3Client) listObjects(bucketName string, prefix string, fn func(obj minio.ObjectInfo)) error {
+	listPrefix := ""
+	if prefix != "" {
+		listPrefix = prefix + "/"
+	}
+	ctx, cancel := context.WithCancel(client.ctx)
+	defer cancel()
+	for obj := range client.minio.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if listPrefix == "" && strings.HasPrefix(obj.Key, snapshotsPrefix+"/") {
+			continue
+		}
+		fn(obj)
+	}
+	return nil
+}
+
+// ownedBucketTag marks a bucket that was created for a volume alone. Unlike
+// the metadata of the volume it survives removing every object of the bucket,
+// so an interrupted DeleteVolume still knows to remove the bucket.
+const ownedBucketTag = "csi-s3.owned"
+
+// MarkBucketOwned records that the bucket was created for a volume alone,
+// keeping the other tags of the bucket.
+func (client *s3Client) MarkBucketOwned(bucketName string) error {
+	t, err := client.bucketTags(bucketName)
+	if err != nil {
+		return err
+	}
+	if t[ownedBucketTag] == "true" {
+		return nil
+	}
+	t[ownedBucketTag] = "true"
+	bucketTags, err := tags.MapToBucketTags(t)
+	if err != nil {
+		return err
+	}
+	return client.minio.SetBucketTagging(client.ctx, bucketName, bucketTags)
+}
+
+// IsBucketOwned reports whether MarkBucketOwned was called for the bucket.
+func (client *s3Client) IsBucketOwned(bucketName string) (bool, error) {
+	t, err := client.bucketTags(bucketName)
+	if err != nil {
+		return false, err
+	}
+	return t[ownedBucketTag] == "true", nil
+}
+
+func (client *s3Client) bucketTags(bucketName string) (map[string]string, error) {
+	bucketTags, err := client.minio.GetBucketTagging(client.ctx, bucketName)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchTagSet" {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	return bucketTags.ToMap(), nil
+}
+
+// RemoveBucket removes an empty bucket.
+func (client *s3Client) RemoveBucket(bucketName string) error {
+	err := client.minio.RemoveBucket(client.ctx, bucketName)
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+		return nil
+	}
+	return err
+}
+
+var errConflict = errors.New("object was changed concurrently")
+
+// IsConflict reports whether err is caused by a concurrent change of the object being written.
+func IsConflict(err error) bool {
+	return errors.Is(err, errConflict)
+}
+
+// IsBucketNotEmpty reports whether err is an S3 error for removing a bucket that still has objects.
+func IsBucketNotEmpty(err error) bool {
+	return minio.ToErrorResponse(err).Code == "BucketNotEmpty"
+}
+
+// IsBucketNotExist reports whether err is an S3 error for a missing bucket.
+func IsBucketNotExist(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchBucket"
+}
+
+// IsNotExist reports whether err is an S3 error for a missing bucket or object.
+func IsNotExist(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchBucket", "NoSuchKey":
+		return true
+	}
+	return false
+}
+
+// ListFSMeta returns the metadata of every volume found either at the root of
+// a bucket or under one of its top level prefixes, ordered by bucket and prefix.
+func (client *s3Client) ListFSMeta() ([]*FSMeta, error) {
+	metas, _, err := client.ListFSMetaAfter("", "", 0)
+	return metas, err
+}
+
+// ListFSMetaAfter returns the metadata of at most limit volumes, or of all
+// volumes for a limit of 0, that follow the volume stored under afterPrefix of
+// afterBucket in the order of ListFSMeta. The volume itself needs not exist
+// anymore. It also reports whether more volumes follow. Only the metadata of
+// the returned volumes is read.
+func (client *s3Client) ListFSMetaAfter(afterBucket, afterPrefix string, limit int) ([]*FSMeta, bool, error) {
+	buckets, err := client.ListBuckets()
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Strings(buckets)
+
+	var metas []*FSMeta
+	more := false
+	for _, bucket := range buckets {
+		if bucket < afterBucket {
+			continue
+		}
+		err := client.listVolumePrefixes(bucket, func(prefix string) (bool, error) {
+			if bucket == afterBucket && prefixKey(prefix) <= prefixKey(afterPrefix) {
+				return true, nil
+			}
+			meta, err := client.GetFSMeta(bucket, prefix)
+			if err != nil {
+				if IsNotExist(err) {
+					return true, nil
+				}
+				return false, fmt.Errorf("failed to get metadata of %s: %w", path.Join(bucket, prefix), err)
+			}
+			if limit > 0 && len(metas) == limit {
+				more = true
+				return false, nil
+			}
+			metas = append(metas, meta)
+			return true, nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if more {
+			break
+		}
+	}
+	return metas, more, nil
+}
+
+// prefixKey returns the key a volume prefix is ordered by in a listing, the
+// root of the bucket comes first.
+func prefixKey(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// ListBucketFSMeta returns the metadata of every volume stored in bucketName.
+func (client *s3Client) ListBucketFSMeta(bucketName string) ([]*FSMeta, error) {
+	var metas []*FSMeta
+	err := client.listVolumePrefixes(bucketName, func(prefix string) (bool, error) {
+		meta, err := client.GetFSMeta(bucketName, prefix)
+		if err != nil {
+			if IsNotExist(err) {
+				return true, nil
+			}
+			return false, fmt.Errorf("failed to get metadata of %s: %w", path.Join(bucketName, prefix), err)
+		}
+		metas = append(metas, meta)
+		return true, nil
+	})
+	return metas, err
+}
+
+// listVolumePrefixes calls fn for the root of bucketName and every top level
+// prefix in it, in listing order, until fn returns false or an error.
+func (client *s3Client) listVolumePrefixes(bucketName string, fn func(prefix string) (bool, error)) error {
+	if next, err := fn(""); err != nil || !next {
+		return err
+	}
+	// stopping early must also stop the lister
+	ctx, cancel := context.WithCancel(client.ctx)
+	defer cancel()
+	for obj := range client.minio.ListObjects(ctx, bucketName, minio.ListObjectsOptions{}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		// directories are returned as keys ending with the delimiter
+		if !strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		if next, err := fn(strings.TrimSuffix(obj.Key, "/")); err != nil || !next {
+			return err
+		}
+	}
+	return nil
 }
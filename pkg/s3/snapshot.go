@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// snapshotsPrefix holds the snapshots of every volume stored in a bucket.
+	// It lives outside the volume prefixes so snapshots outlive their source.
+	snapshotsPrefix      = ".csi-snapshots"
+	snapshotMetadataName = ".snapshot.json"
+	snapshotDataPrefix   = "data"
+)
+
+type SnapshotMeta struct {
+	Name           string    `json:"Name"`
+	BucketName     string    `json:"BucketName"`
+	SourceVolumeID string    `json:"SourceVolumeID"`
+	CreationTime   time.Time `json:"CreationTime"`
+	ReadyToUse     bool      `json:"ReadyToUse"`
+	// Volume is the metadata of the source volume at the time of the snapshot
+	Volume FSMeta `json:"Volume"`
+}
+
+// Prefix returns the prefix the snapshot is stored under within its bucket.
+func (snap *SnapshotMeta) Prefix() string {
+	return SnapshotPrefix(snap.Name)
+}
+
+// DataPrefix returns the prefix holding the copied volume contents.
+func (snap *SnapshotMeta) DataPrefix() string {
+	return path.Join(snap.Prefix(), snapshotDataPrefix)
+}
+
+// SnapshotPrefix returns the prefix a snapshot with the given name is stored under.
+func SnapshotPrefix(name string) string {
+	return path.Join(snapshotsPrefix, name)
+}
+
+// SnapshotName returns the snapshot name from a prefix built by SnapshotPrefix.
+// ok is false when the prefix does not point at a snapshot.
+func SnapshotName(prefix string) (name string, ok bool) {
+	name = strings.TrimPrefix(prefix, snapshotsPrefix+"/")
+	if name == prefix || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+func (client *s3Client) SetSnapshotMeta(snap *SnapshotMeta) error {
+	return client.putJSON(snap.BucketName, path.Join(snap.Prefix(), snapshotMetadataName), snap)
+}
+
+// GetSnapshotMeta get metadata of a snapshot
+func (client *s3Client) GetSnapshotMeta(bucketName, name string) (*SnapshotMeta, error) {
+	var snap SnapshotMeta
+	if err := client.getJSON(bucketName, path.Join(SnapshotPrefix(name), snapshotMetadataName), &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// RemoveSnapshot removes the contents of a snapshot and then its metadata.
+func (client *s3Client) RemoveSnapshot(bucketName, name string) error {
+	prefix := SnapshotPrefix(name)
+	if err := client.RemovePrefix(bucketName, path.Join(prefix, snapshotDataPrefix)); err != nil {
+		return err
+	}
+	return client.RemovePrefix(bucketName, prefix)
+}
+
+// ListSnapshotMeta returns the metadata of every snapshot stored in bucketName.
+func (client *s3Client) ListSnapshotMeta(bucketName string) ([]*SnapshotMeta, error) {
+	var names []string
+	opts := minio.ListObjectsOptions{Prefix: snapshotsPrefix + "/"}
+	for obj := range client.minio.ListObjects(client.ctx, bucketName, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if name, ok := SnapshotName(strings.TrimSuffix(obj.Key, "/")); ok {
+			names = append(names, name)
+		}
+	}
+
+	var snaps []*SnapshotMeta
+	for _, name := range names {
+		snap, err := client.GetSnapshotMeta(bucketName, name)
+		if err != nil {
+			if IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}